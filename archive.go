@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// maximum size of an image embedded from an archive
+const maxArchiveImageSize = 5 << 20
+
+// archiveSource reads the tweets from the archive that Twitter provides for download (Settings > Your account >
+// Download an archive of your data). No API requests are made, the images in the archive are embedded into the
+// digest.
+type archiveSource struct {
+	app    app
+	source timelineSource
+
+	// tweets are the tweets in the digest window, newest first. They are read on the first page.
+	tweets []anaconda.Tweet
+	loaded bool
+}
+
+// archiveTweet is a tweet as stored in data/tweets.js. Unlike the API, the archive stores numbers as strings.
+type archiveTweet struct {
+	ID                  string          `json:"id_str"`
+	FullText            string          `json:"full_text"`
+	CreatedAt           string          `json:"created_at"`
+	Lang                string          `json:"lang"`
+	FavoriteCount       archiveInt      `json:"favorite_count"`
+	RetweetCount        archiveInt      `json:"retweet_count"`
+	InReplyToStatusID   string          `json:"in_reply_to_status_id_str"`
+	InReplyToUserID     string          `json:"in_reply_to_user_id_str"`
+	InReplyToScreenName string          `json:"in_reply_to_screen_name"`
+	Entities            archiveEntities `json:"entities"`
+	ExtendedEntities    archiveEntities `json:"extended_entities"`
+}
+
+type archiveEntities struct {
+	Urls []struct {
+		URL         string       `json:"url"`
+		ExpandedURL string       `json:"expanded_url"`
+		DisplayURL  string       `json:"display_url"`
+		Indices     []archiveInt `json:"indices"`
+	} `json:"urls"`
+	UserMentions []struct {
+		Name       string       `json:"name"`
+		ScreenName string       `json:"screen_name"`
+		ID         archiveInt   `json:"id_str"`
+		Indices    []archiveInt `json:"indices"`
+	} `json:"user_mentions"`
+	Hashtags []struct {
+		Text    string       `json:"text"`
+		Indices []archiveInt `json:"indices"`
+	} `json:"hashtags"`
+	Media []struct {
+		ID            archiveInt   `json:"id_str"`
+		MediaURL      string       `json:"media_url"`
+		MediaURLHTTPS string       `json:"media_url_https"`
+		URL           string       `json:"url"`
+		ExpandedURL   string       `json:"expanded_url"`
+		DisplayURL    string       `json:"display_url"`
+		Type          string       `json:"type"`
+		Indices       []archiveInt `json:"indices"`
+	} `json:"media"`
+}
+
+// archiveInt is a number that the archive may store as a string
+type archiveInt int64
+
+func (n *archiveInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	*n = archiveInt(v)
+	return err
+}
+
+// archiveAccount holds the account the archive belongs to, from data/account.js and data/profile.js
+type archiveAccount struct {
+	Account struct {
+		Username    string     `json:"username"`
+		AccountID   archiveInt `json:"accountId"`
+		DisplayName string     `json:"accountDisplayName"`
+	} `json:"account"`
+	Profile struct {
+		AvatarMediaURL string `json:"avatarMediaUrl"`
+	} `json:"profile"`
+}
+
+// archiveTweetsRE matches the files holding the tweets, large archives split them into several parts
+var archiveTweetsRE = regexp.MustCompile(`^data/tweets?(-part[0-9]+)?\.js$`)
+
+// archiveRetweetRE matches the start of the text of a retweet, the archive doesn't include the retweeted tweet
+var archiveRetweetRE = regexp.MustCompile(`^RT @([A-Za-z0-9_]+): `)
+
+// Page returns a page of the tweets in the archive, reading the archive on the first page. Only the tweets in
+// the digest window (or newer than sinceID) are returned and the images of the returned tweets are embedded.
+func (s *archiveSource) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	r, err := zip.OpenReader(s.source.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		// some tools add a top level directory when the archive is repacked
+		name := f.Name
+		if i := strings.Index(name, "data/"); i > 0 {
+			name = name[i:]
+		}
+		files[name] = f
+	}
+
+	if !s.loaded {
+		if s.tweets, err = s.load(files, sinceID); err != nil {
+			return nil, "", err
+		}
+		s.loaded = true
+		log.Debug().Int("tweet-count", len(s.tweets)).Str("source", s.source.String()).Msg("read tweets from archive")
+	}
+
+	offset, _ := strconv.Atoi(cursor)
+	if offset >= len(s.tweets) {
+		return nil, "", nil
+	}
+	end := offset + s.app.Config.TweetCount
+	next := strconv.Itoa(end)
+	if end >= len(s.tweets) {
+		end, next = len(s.tweets), ""
+	}
+
+	page := make([]anaconda.Tweet, end-offset)
+	for i, t := range s.tweets[offset:end] {
+		page[i] = embedArchiveMedia(files, t)
+		if t.RetweetedStatus != nil {
+			rt := embedArchiveMedia(files, *t.RetweetedStatus)
+			page[i].RetweetedStatus = &rt
+		}
+	}
+
+	return page, next, nil
+}
+
+// load reads the account and the tweets from the archive
+func (s *archiveSource) load(files map[string]*zip.File, sinceID int64) ([]anaconda.Tweet, error) {
+	var user anaconda.User
+	var accounts []archiveAccount
+	if err := readArchiveFile(files, "data/account.js", &accounts); err == nil && len(accounts) > 0 {
+		a := accounts[0].Account
+		user = anaconda.User{Id: int64(a.AccountID), IdStr: strconv.FormatInt(int64(a.AccountID), 10), ScreenName: a.Username, Name: a.DisplayName}
+	}
+	var profiles []archiveAccount
+	if err := readArchiveFile(files, "data/profile.js", &profiles); err == nil && len(profiles) > 0 {
+		user.ProfileImageURL = profiles[0].Profile.AvatarMediaURL
+		user.ProfileImageUrlHttps = profiles[0].Profile.AvatarMediaURL
+	}
+	if user.ScreenName == "" {
+		return nil, fmt.Errorf("%s: data/account.js is missing, is this a Twitter archive?", s.source.Name)
+	}
+	if user.Name == "" {
+		user.Name = user.ScreenName
+	}
+
+	var names []string
+	for name := range files {
+		if archiveTweetsRE.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: data/tweets.js is missing, is this a Twitter archive?", s.source.Name)
+	}
+
+	window := s.app.window()
+	var tweets []anaconda.Tweet
+	for _, name := range names {
+		var items []struct {
+			Tweet *archiveTweet `json:"tweet"`
+		}
+		var flat []archiveTweet
+		if err := readArchiveFile(files, name, &items); err != nil {
+			return nil, err
+		}
+		// older archives don't wrap the tweets
+		if len(items) > 0 && items[0].Tweet == nil {
+			if err := readArchiveFile(files, name, &flat); err != nil {
+				return nil, err
+			}
+		}
+		for _, item := range items {
+			if item.Tweet != nil {
+				flat = append(flat, *item.Tweet)
+			}
+		}
+
+		for _, at := range flat {
+			t := at.convert(user)
+			created, err := t.CreatedAtTime()
+			if err != nil {
+				log.Debug().Err(err).Str("id", at.ID).Msg("skipping archived tweet without a valid creation time")
+				continue
+			}
+			if sinceID > 0 && t.Id <= sinceID {
+				continue
+			}
+			if sinceID == 0 && !window.contains(created) {
+				continue
+			}
+			tweets = append(tweets, t)
+		}
+	}
+
+	sort.Slice(tweets, func(i, j int) bool { return tweets[i].Id > tweets[j].Id })
+	return tweets, nil
+}
+
+// readArchiveFile decodes one of the JavaScript files of the archive, which assign a JSON array to a variable
+func readArchiveFile(files map[string]*zip.File, name string, out interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%s not found in the archive", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if i := bytes.IndexByte(data, '='); i >= 0 && i < bytes.IndexByte(data, '[') {
+		data = data[i+1:]
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// convert maps an archived tweet into the model consumed by the templates. Retweets are mapped onto a retweeted
+// tweet which holds the text after the "RT @user: " prefix.
+func (at archiveTweet) convert(user anaconda.User) anaconda.Tweet {
+	t := anaconda.Tweet{
+		IdStr:                at.ID,
+		FullText:             at.FullText,
+		Text:                 at.FullText,
+		CreatedAt:            at.CreatedAt,
+		Lang:                 at.Lang,
+		FavoriteCount:        int(at.FavoriteCount),
+		RetweetCount:         int(at.RetweetCount),
+		InReplyToStatusIdStr: at.InReplyToStatusID,
+		InReplyToUserIdStr:   at.InReplyToUserID,
+		InReplyToScreenName:  at.InReplyToScreenName,
+		User:                 user,
+		Entities:             at.Entities.convert(0),
+		ExtendedEntities:     at.ExtendedEntities.convert(0),
+	}
+	t.Id, _ = strconv.ParseInt(at.ID, 10, 64)
+	t.InReplyToStatusID, _ = strconv.ParseInt(at.InReplyToStatusID, 10, 64)
+	t.InReplyToUserID, _ = strconv.ParseInt(at.InReplyToUserID, 10, 64)
+
+	m := archiveRetweetRE.FindStringSubmatch(at.FullText)
+	if m == nil {
+		return t
+	}
+
+	prefix := utf8.RuneCountInString(m[0])
+	rt := t
+	rt.FullText = at.FullText[len(m[0]):]
+	rt.Text = rt.FullText
+	rt.Entities = at.Entities.convert(prefix)
+	rt.ExtendedEntities = at.ExtendedEntities.convert(prefix)
+	rt.InReplyToStatusIdStr, rt.InReplyToStatusID, rt.InReplyToUserIdStr, rt.InReplyToUserID = "", 0, "", 0
+	rt.User = anaconda.User{ScreenName: m[1], Name: m[1]}
+	for _, mention := range at.Entities.UserMentions {
+		if strings.EqualFold(mention.ScreenName, m[1]) {
+			rt.User.Name, rt.User.Id = mention.Name, int64(mention.ID)
+			break
+		}
+	}
+	t.RetweetedStatus = &rt
+
+	return t
+}
+
+// convert maps the archived entities, shifting the indices by offset. Entities before offset are dropped.
+func (e archiveEntities) convert(offset int) anaconda.Entities {
+	var out anaconda.Entities
+	indices := func(in []archiveInt) ([]int, bool) {
+		if len(in) != 2 || int(in[0]) < offset {
+			return nil, false
+		}
+		return []int{int(in[0]) - offset, int(in[1]) - offset}, true
+	}
+
+	for _, u := range e.Urls {
+		if i, ok := indices(u.Indices); ok {
+			out.Urls = append(out.Urls, urlEntity{Indices: i, Url: u.URL, Display_url: u.DisplayURL, Expanded_url: u.ExpandedURL})
+		}
+	}
+	for _, m := range e.UserMentions {
+		if i, ok := indices(m.Indices); ok {
+			out.User_mentions = append(out.User_mentions, mentionEntity{Indices: i, Name: m.Name, Screen_name: m.ScreenName, Id: int64(m.ID), Id_str: strconv.FormatInt(int64(m.ID), 10)})
+		}
+	}
+	for _, h := range e.Hashtags {
+		if i, ok := indices(h.Indices); ok {
+			out.Hashtags = append(out.Hashtags, hashtagEntity{Indices: i, Text: h.Text})
+		}
+	}
+	for _, m := range e.Media {
+		i, ok := indices(m.Indices)
+		if !ok {
+			continue
+		}
+		media := mediaEntity(m.MediaURLHTTPS, m.Type)
+		media.Id, media.Id_str = int64(m.ID), strconv.FormatInt(int64(m.ID), 10)
+		media.Media_url, media.Url, media.Display_url, media.Expanded_url = m.MediaURL, m.URL, m.DisplayURL, m.ExpandedURL
+		media.Indices = i
+		out.Media = append(out.Media, media)
+	}
+
+	return out
+}
+
+// embedArchiveMedia replaces the URLs of the images of a tweet with data URIs of the copies in the archive.
+// Videos and GIFs are only stored as MP4 files, so their thumbnails are still loaded from Twitter.
+func embedArchiveMedia(files map[string]*zip.File, t anaconda.Tweet) anaconda.Tweet {
+	if len(t.ExtendedEntities.Media) == 0 {
+		return t
+	}
+
+	media := make([]anaconda.EntityMedia, len(t.ExtendedEntities.Media))
+	copy(media, t.ExtendedEntities.Media)
+	for i, m := range media {
+		base := path.Base(m.Media_url_https)
+		for _, dir := range []string{"data/tweets_media/", "data/tweet_media/"} {
+			f, ok := files[dir+t.IdStr+"-"+base]
+			if !ok {
+				continue
+			}
+			if uri, err := dataURI(f); err == nil {
+				media[i].Media_url_https = uri
+			} else {
+				log.Debug().Err(err).Str("file", f.Name).Msg("unable to embed archived media")
+			}
+			break
+		}
+	}
+	t.ExtendedEntities.Media = media
+
+	return t
+}
+
+// dataURI returns the data URI of an image in the archive
+func dataURI(f *zip.File) (string, error) {
+	typ := mime.TypeByExtension(strings.ToLower(path.Ext(f.Name)))
+	switch typ {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return "", fmt.Errorf("%s is not an image", f.Name)
+	}
+	if f.UncompressedSize64 > maxArchiveImageSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", f.Name, maxArchiveImageSize)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+
+	return "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestArchiveLoad(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"data/account.js": `window.YTD.account.part0 = [{"account": {"username": "jakewarren", "accountId": "42", "accountDisplayName": "Jake"}}]`,
+		"data/tweets.js": `window.YTD.tweets.part0 = [
+			{"tweet": {"id_str": "1", "full_text": "too old", "created_at": "Mon Jan 02 15:04:05 +0000 2012"}},
+			{"tweet": {"id_str": "2", "full_text": "reply", "created_at": "Mon Jan 02 15:04:05 +0000 2017", "favorite_count": "3",
+				"in_reply_to_status_id_str": "1", "in_reply_to_user_id_str": "42"}},
+			{"tweet": {"id_str": "3", "full_text": "no date", "created_at": ""}}
+		]`,
+		// older archives don't wrap the tweets, large ones are split into parts
+		"data/tweets-part1.js": `window.YTD.tweets.part1 = [
+			{"id_str": "4", "full_text": "RT @golang: Gö https://t.co/y", "created_at": "Tue Jan 03 15:04:05 +0000 2017", "retweet_count": 7,
+				"entities": {"urls": [{"url": "https://t.co/y", "expanded_url": "https://go.dev", "indices": ["15", "29"]}],
+					"user_mentions": [{"screen_name": "golang", "name": "Go", "id_str": "7", "indices": [3, 10]}]}}
+		]`,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	s := &archiveSource{source: timelineSource{Kind: sourceArchive, Name: "archive.zip"}}
+	s.app.Config.From = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	tweets, err := s.load(files, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newest first, without the tweets outside the window or without a date
+	if len(tweets) != 2 || tweets[0].IdStr != "4" || tweets[1].IdStr != "2" {
+		t.Fatalf("load() returned %d tweets, want 4 and 2: %+v", len(tweets), tweets)
+	}
+	if reply := tweets[1]; reply.User.ScreenName != "jakewarren" || reply.User.Id != 42 || reply.FavoriteCount != 3 || reply.InReplyToStatusID != 1 || reply.InReplyToUserID != 42 {
+		t.Errorf("reply = %+v", reply)
+	}
+
+	rt := tweets[0].RetweetedStatus
+	if rt == nil || rt.User.ScreenName != "golang" || rt.User.Id != 7 || rt.FullText != "Gö https://t.co/y" || rt.RetweetCount != 7 {
+		t.Fatalf("retweeted status = %+v", rt)
+	}
+	// the entities of the retweeted tweet are shifted past "RT @golang: " and the mention of the author is dropped
+	if len(rt.Entities.Urls) != 1 || rt.Entities.Urls[0].Indices[0] != 3 || rt.Entities.Urls[0].Indices[1] != 17 || len(rt.Entities.User_mentions) != 0 {
+		t.Errorf("retweeted entities = %+v", rt.Entities)
+	}
+
+	if _, err := s.load(map[string]*zip.File{"data/account.js": files["data/account.js"]}, 0); err == nil {
+		t.Error("load() without tweets.js succeeded")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// blueskyBaseURL is the public AppView, which serves author feeds without authentication
+const blueskyBaseURL = "https://public.api.bsky.app/xrpc/"
+
+// maximum number of posts returned by a single getAuthorFeed request
+const maxBlueskyCount = 100
+
+// embed and reason types used by the AppView
+const (
+	blueskyReasonRepost         = "app.bsky.feed.defs#reasonRepost"
+	blueskyEmbedImages          = "app.bsky.embed.images#view"
+	blueskyEmbedVideo           = "app.bsky.embed.video#view"
+	blueskyEmbedExternal        = "app.bsky.embed.external#view"
+	blueskyEmbedRecord          = "app.bsky.embed.record#view"
+	blueskyEmbedRecordWithMedia = "app.bsky.embed.recordWithMedia#view"
+	blueskyViewRecord           = "app.bsky.embed.record#viewRecord"
+)
+
+// blueskyClient requests author feeds from the Bluesky AppView
+type blueskyClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newBlueskyClient() *blueskyClient {
+	return &blueskyClient{
+		baseURL: blueskyBaseURL,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type blueskyFeed struct {
+	Feed   []blueskyFeedItem `json:"feed"`
+	Cursor string            `json:"cursor"`
+}
+
+type blueskyFeedItem struct {
+	Post  blueskyPost `json:"post"`
+	Reply *struct {
+		Parent blueskyPost `json:"parent"`
+	} `json:"reply"`
+	Reason *struct {
+		Type      string         `json:"$type"`
+		By        blueskyProfile `json:"by"`
+		IndexedAt string         `json:"indexedAt"`
+	} `json:"reason"`
+}
+
+type blueskyProfile struct {
+	DID         string `json:"did"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar"`
+}
+
+type blueskyPost struct {
+	URI         string         `json:"uri"`
+	Author      blueskyProfile `json:"author"`
+	Record      blueskyRecord  `json:"record"`
+	Embed       *blueskyEmbed  `json:"embed"`
+	RepostCount int            `json:"repostCount"`
+	LikeCount   int            `json:"likeCount"`
+	IndexedAt   string         `json:"indexedAt"`
+}
+
+type blueskyRecord struct {
+	Text      string         `json:"text"`
+	CreatedAt string         `json:"createdAt"`
+	Langs     []string       `json:"langs"`
+	Facets    []blueskyFacet `json:"facets"`
+	Reply     *struct {
+		Parent struct {
+			URI string `json:"uri"`
+		} `json:"parent"`
+	} `json:"reply"`
+}
+
+type blueskyFacet struct {
+	Index struct {
+		ByteStart int `json:"byteStart"`
+		ByteEnd   int `json:"byteEnd"`
+	} `json:"index"`
+	Features []struct {
+		Type string `json:"$type"`
+		URI  string `json:"uri"`
+		DID  string `json:"did"`
+	} `json:"features"`
+}
+
+type blueskyEmbed struct {
+	Type   string `json:"$type"`
+	Images []struct {
+		Fullsize string `json:"fullsize"`
+	} `json:"images"`
+	Thumbnail string `json:"thumbnail"`
+	External  *struct {
+		URI   string `json:"uri"`
+		Title string `json:"title"`
+	} `json:"external"`
+	// Record is the quoted post, for a recordWithMedia embed it is wrapped in another record view
+	Record *blueskyRecordView `json:"record"`
+	// Media is the images, video or link card of a recordWithMedia embed
+	Media *blueskyEmbed `json:"media"`
+}
+
+type blueskyRecordView struct {
+	Type        string             `json:"$type"`
+	URI         string             `json:"uri"`
+	Author      blueskyProfile     `json:"author"`
+	Value       blueskyRecord      `json:"value"`
+	Embeds      []blueskyEmbed     `json:"embeds"`
+	RepostCount int                `json:"repostCount"`
+	LikeCount   int                `json:"likeCount"`
+	IndexedAt   string             `json:"indexedAt"`
+	Record      *blueskyRecordView `json:"record"`
+}
+
+// blueskySource retrieves the posts of a Bluesky account
+type blueskySource struct {
+	app    app
+	client *blueskyClient
+	source timelineSource
+}
+
+// Page requests a single page of the author feed, retrying according to the retry policy. The feed can't be
+// limited to newer posts, so posts at or before sinceID are dropped here.
+func (b blueskySource) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	a, s := b.app, b.source
+
+	count := a.Config.TweetCount
+	if count > maxBlueskyCount {
+		count = maxBlueskyCount
+	}
+	v := url.Values{}
+	v.Set("actor", s.Name)
+	v.Set("limit", strconv.Itoa(count))
+	// threads of the author are kept so the reply filter can handle them like self-replies on Twitter
+	if a.Config.IncludeReplies {
+		v.Set("filter", "posts_with_replies")
+	} else {
+		v.Set("filter", "posts_and_author_threads")
+	}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+
+	var feed blueskyFeed
+	u := b.client.baseURL + "app.bsky.feed.getAuthorFeed?" + v.Encode()
+	err := a.Config.Retry.do(ctx, "getAuthorFeed "+s.Name, func() error {
+		feed = blueskyFeed{}
+		return getJSON(ctx, b.client.http, u, nil, &feed)
+	})
+	log.Debug().Int("tweet-count", len(feed.Feed)).Str("source", s.String()).Str("cursor", cursor).Msg("pulled down posts")
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := feed.Cursor
+	tweets := make([]anaconda.Tweet, 0, len(feed.Feed))
+	for _, item := range feed.Feed {
+		tweet := item.convert()
+		if sinceID > 0 && tweet.Id <= sinceID {
+			next = ""
+			continue
+		}
+		tweets = append(tweets, tweet)
+	}
+
+	return tweets, next, nil
+}
+
+// Parent requests the post a reply responds to, retrying according to the retry policy
+func (b blueskySource) Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error) {
+	rkey := reply.InReplyToStatusIdStr[strings.LastIndex(reply.InReplyToStatusIdStr, "/")+1:]
+	uri := "at://" + reply.InReplyToUserIdStr + "/app.bsky.feed.post/" + rkey
+
+	var resp struct {
+		Posts []blueskyPost `json:"posts"`
+	}
+	u := b.client.baseURL + "app.bsky.feed.getPosts?" + url.Values{"uris": {uri}}.Encode()
+	err := b.app.Config.Retry.do(ctx, "getPosts "+uri, func() error {
+		resp.Posts = nil
+		return getJSON(ctx, b.client.http, u, nil, &resp)
+	})
+	if err != nil {
+		return anaconda.Tweet{}, err
+	}
+	if len(resp.Posts) == 0 {
+		return anaconda.Tweet{}, fmt.Errorf("post %s was not found", uri)
+	}
+	return resp.Posts[0].convert(), nil
+}
+
+// convert maps a feed item into the model consumed by the templates. Reposts are mapped onto retweets and quoted
+// posts and link cards are linked from the text like they are on Twitter.
+func (item blueskyFeedItem) convert() anaconda.Tweet {
+	tweet := item.Post.convert()
+	if item.Reply != nil && item.Reply.Parent.Author.Handle != "" {
+		tweet.InReplyToScreenName = item.Reply.Parent.Author.Handle
+	}
+
+	if item.Reason == nil || item.Reason.Type != blueskyReasonRepost {
+		return tweet
+	}
+
+	created := blueskyTime(item.Reason.IndexedAt, "")
+	repost := anaconda.Tweet{
+		Id:              unixMilli(created),
+		IdStr:           tweet.IdStr,
+		CreatedAt:       createdAt(created),
+		FullText:        "RT @" + tweet.User.ScreenName + ": " + tweet.FullText,
+		User:            item.Reason.By.user(),
+		RetweetedStatus: &tweet,
+	}
+	repost.Text = repost.FullText
+	return repost
+}
+
+// convert maps a post into the model consumed by the templates
+func (p blueskyPost) convert() anaconda.Tweet {
+	created := blueskyTime(p.Record.CreatedAt, p.IndexedAt)
+	text, urls, mentions := facetText(p.Record.Text, p.Record.Facets)
+
+	tweet := anaconda.Tweet{
+		Id:            unixMilli(created),
+		IdStr:         blueskyPostURL(p.Author.Handle, p.URI),
+		FullText:      text,
+		Text:          text,
+		CreatedAt:     createdAt(created),
+		RetweetCount:  p.RepostCount,
+		FavoriteCount: p.LikeCount,
+		User:          p.Author.user(),
+	}
+	tweet.Entities.Urls = urls
+	tweet.Entities.User_mentions = mentions
+	if len(p.Record.Langs) > 0 {
+		tweet.Lang = p.Record.Langs[0]
+	}
+
+	if p.Record.Reply != nil {
+		// the author of the parent is part of its URI, even when the parent was deleted
+		parent := p.Record.Reply.Parent.URI
+		did := blueskyDID(parent)
+		tweet.InReplyToStatusIdStr = blueskyPostURL(did, parent)
+		if did == p.Author.DID {
+			// link self-replies the same way as the parent post, so threads can be put back together
+			tweet.InReplyToStatusIdStr = blueskyPostURL(p.Author.Handle, parent)
+		}
+		tweet.InReplyToUserIdStr = did
+		tweet.InReplyToUserID = hashID(did)
+	}
+
+	if p.Embed != nil {
+		addEmbed(&tweet, *p.Embed)
+	}
+
+	return tweet
+}
+
+// addEmbed adds the images, video, link card or quoted post embedded in a post to the tweet
+func addEmbed(tweet *anaconda.Tweet, e blueskyEmbed) {
+	switch e.Type {
+	case blueskyEmbedImages:
+		for _, img := range e.Images {
+			if src := safeURL(img.Fullsize); src != "" {
+				tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(src, "photo"))
+			}
+		}
+	case blueskyEmbedVideo:
+		if src := safeURL(e.Thumbnail); src != "" {
+			tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(src, "video"))
+		}
+	case blueskyEmbedExternal:
+		if e.External != nil {
+			appendURL(tweet, e.External.URI)
+		}
+	case blueskyEmbedRecord, blueskyEmbedRecordWithMedia:
+		record := e.Record
+		if e.Type == blueskyEmbedRecordWithMedia && record != nil {
+			record = record.Record
+		}
+		if e.Media != nil {
+			addEmbed(tweet, *e.Media)
+		}
+		if record == nil || record.Type != blueskyViewRecord {
+			// the quoted post was deleted or blocked, or it is a feed or list
+			return
+		}
+		quoted := record.post().convert()
+		tweet.QuotedStatus = &quoted
+		tweet.QuotedStatusIdStr = quoted.IdStr
+		appendURL(tweet, quoted.IdStr)
+	}
+}
+
+// post returns the quoted post in the shape of a feed post
+func (r blueskyRecordView) post() blueskyPost {
+	p := blueskyPost{
+		URI:         r.URI,
+		Author:      r.Author,
+		Record:      r.Value,
+		RepostCount: r.RepostCount,
+		LikeCount:   r.LikeCount,
+		IndexedAt:   r.IndexedAt,
+	}
+	if len(r.Embeds) > 0 {
+		p.Embed = &r.Embeds[0]
+	}
+	return p
+}
+
+// user maps a profile into the model consumed by the templates
+func (p blueskyProfile) user() anaconda.User {
+	name := p.DisplayName
+	if name == "" {
+		name = p.Handle
+	}
+	return anaconda.User{
+		Id:                   hashID(p.DID),
+		IdStr:                "https://bsky.app/profile/" + blueskyActor(p.Handle, p.DID),
+		Name:                 name,
+		ScreenName:           blueskyActor(p.Handle, p.DID),
+		ProfileImageURL:      p.Avatar,
+		ProfileImageUrlHttps: p.Avatar,
+	}
+}
+
+// blueskyActor returns the handle, or the DID if the handle doesn't resolve
+func blueskyActor(handle, did string) string {
+	if handle == "" || handle == "handle.invalid" {
+		return did
+	}
+	return handle
+}
+
+// blueskyPostURL returns the web URL of the post identified by an at:// URI
+func blueskyPostURL(actor, uri string) string {
+	actor = blueskyActor(actor, blueskyDID(uri))
+	rkey := uri[strings.LastIndex(uri, "/")+1:]
+	return "https://bsky.app/profile/" + actor + "/post/" + rkey
+}
+
+// blueskyDID returns the DID of the repository of an at:// URI
+func blueskyDID(uri string) string {
+	did := strings.TrimPrefix(uri, "at://")
+	if i := strings.Index(did, "/"); i >= 0 {
+		did = did[:i]
+	}
+	return did
+}
+
+// blueskyTime parses the time of a post, falling back to the time the post was indexed if the client didn't set
+// a valid creation time
+func blueskyTime(created, indexed string) time.Time {
+	for _, v := range []string{created, indexed} {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// facetText escapes the text of a post the same way as the text of tweets and converts the link and mention facets,
+// which use UTF-8 byte offsets, into entities
+func facetText(text string, facets []blueskyFacet) (string, []urlEntity, []mentionEntity) {
+	var (
+		buf      strings.Builder
+		urls     []urlEntity
+		mentions []mentionEntity
+		// offsets maps the byte offsets in the text to the rune offsets in the escaped text
+		offsets = make([]int, len(text)+1)
+		runes   int
+	)
+	for i := 0; i < len(text); {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		for j := 0; j < size; j++ {
+			offsets[i+j] = runes
+		}
+		s := twitterEscaper.Replace(text[i : i+size])
+		buf.WriteString(s)
+		runes += utf8.RuneCountInString(s)
+		i += size
+	}
+	offsets[len(text)] = runes
+
+	for _, f := range facets {
+		start, end := f.Index.ByteStart, f.Index.ByteEnd
+		if start < 0 || end > len(text) || start >= end {
+			continue
+		}
+		indices := []int{offsets[start], offsets[end]}
+		for _, feature := range f.Features {
+			switch feature.Type {
+			case "app.bsky.richtext.facet#link":
+				if href := safeURL(feature.URI); href != "" {
+					urls = append(urls, urlEntity{Indices: indices, Url: href, Display_url: text[start:end], Expanded_url: href})
+				}
+			case "app.bsky.richtext.facet#mention":
+				mentions = append(mentions, mentionEntity{Indices: indices, Screen_name: strings.TrimPrefix(text[start:end], "@"), Id_str: "https://bsky.app/profile/" + feature.DID})
+			}
+		}
+	}
+
+	return buf.String(), urls, mentions
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFacetText(t *testing.T) {
+	// byte offsets of the facets: "é" takes two bytes, "🎉" four
+	text := "héllo 🎉 @alice.bsky.social & https://go.dev"
+	var facets []blueskyFacet
+	err := json.Unmarshal([]byte(`[
+		{"index": {"byteStart": 12, "byteEnd": 30}, "features": [{"$type": "app.bsky.richtext.facet#mention", "did": "did:plc:alice"}]},
+		{"index": {"byteStart": 33, "byteEnd": 47}, "features": [{"$type": "app.bsky.richtext.facet#link", "uri": "https://go.dev"}]},
+		{"index": {"byteStart": 33, "byteEnd": 48}, "features": [{"$type": "app.bsky.richtext.facet#link", "uri": "https://go.dev"}]},
+		{"index": {"byteStart": 0, "byteEnd": 5}, "features": [{"$type": "app.bsky.richtext.facet#link", "uri": "javascript:alert(1)"}]}
+	]`), &facets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	escaped, urls, mentions := facetText(text, facets)
+	if want := "héllo 🎉 @alice.bsky.social &amp; https://go.dev"; escaped != want {
+		t.Errorf("text = %q, want %q", escaped, want)
+	}
+	// the indices count the runes of the escaped text, the facet past the end of the text and the unsafe link are
+	// dropped
+	if len(mentions) != 1 || mentions[0].Indices[0] != 8 || mentions[0].Indices[1] != 26 || mentions[0].Screen_name != "alice.bsky.social" {
+		t.Errorf("mentions = %+v, want alice.bsky.social at [8 26]", mentions)
+	}
+	if len(urls) != 1 || urls[0].Indices[0] != 33 || urls[0].Indices[1] != 47 {
+		t.Errorf("urls = %+v, want https://go.dev at [33 47]", urls)
+	}
+}
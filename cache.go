@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apppaths "github.com/muesli/go-app-paths"
+	"github.com/rs/zerolog/log"
+)
+
+// cachedLink is the on-disk representation of an enriched link
+type cachedLink struct {
+	FinalURL    string    `json:"final_url,omitempty"`
+	Images      []string  `json:"images,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Card        string    `json:"card,omitempty"`
+	Preview     bool      `json:"preview,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// linkCache persists unshortened URLs and link preview metadata between runs.
+// A nil *linkCache is valid and caches nothing.
+type linkCache struct {
+	path     string
+	ttl      time.Duration
+	errorTTL time.Duration
+	mu       sync.Mutex
+	dirty    bool
+	Links    map[string]cachedLink `json:"links"`
+}
+
+// defaultCachePath returns the location of the link cache inside the user's cache directory
+func defaultCachePath() (string, error) {
+	userScope := apppaths.NewScope(apppaths.User, "", "tweetdigest")
+	cacheDir, err := userScope.CacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "links.json"), nil
+}
+
+// loadLinkCache reads the cache file at path. A missing file results in an empty cache.
+func loadLinkCache(path string, ttl, errorTTL time.Duration) (*linkCache, error) {
+	c := &linkCache{
+		path:     path,
+		ttl:      ttl,
+		errorTTL: errorTTL,
+		Links:    make(map[string]cachedLink),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Links == nil {
+		c.Links = make(map[string]cachedLink)
+	}
+
+	return c, nil
+}
+
+// expired reports whether a cache entry is older than its TTL. Failed lookups use the (shorter) error TTL.
+func (c *linkCache) expired(l cachedLink, now time.Time) bool {
+	ttl := c.ttl
+	if l.Error != "" {
+		ttl = c.errorTTL
+	}
+	return now.Sub(l.FetchedAt) > ttl
+}
+
+// Get returns the cached preview for a URL. Entries without preview metadata don't satisfy requests that need it.
+func (c *linkCache) Get(r linkRequest) (*linkPreview, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.Links[r.URL]
+	if !ok || c.expired(l, time.Now()) || (r.Preview && !l.Preview && l.Error == "") {
+		return nil, false
+	}
+
+	return &linkPreview{
+		URL:         r.URL,
+		FinalURL:    l.FinalURL,
+		Images:      l.Images,
+		Title:       l.Title,
+		Description: l.Description,
+		Card:        l.Card,
+	}, true
+}
+
+// Put stores the result of enriching a link. A non-nil err is cached as a failed lookup.
+func (c *linkCache) Put(r linkRequest, p *linkPreview, err error) {
+	if c == nil {
+		return
+	}
+
+	l := cachedLink{
+		FinalURL:    p.FinalURL,
+		Images:      p.Images,
+		Title:       p.Title,
+		Description: p.Description,
+		Card:        p.Card,
+		Preview:     r.Preview,
+		FetchedAt:   time.Now(),
+	}
+	if err != nil {
+		l.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Links[r.URL] = l
+	c.dirty = true
+}
+
+// Prune removes all expired entries and returns how many were removed
+func (c *linkCache) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for u, l := range c.Links {
+		if c.expired(l, now) {
+			delete(c.Links, u)
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.dirty = true
+	}
+
+	return removed
+}
+
+// Save writes the cache to disk if it was modified
+func (c *linkCache) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return err
+	}
+	c.dirty = false
+
+	return nil
+}
+
+// cacheStats summarizes the contents of the link cache
+type cacheStats struct {
+	Entries  int
+	Failed   int
+	Expired  int
+	Previews int
+	Oldest   time.Time
+	Newest   time.Time
+}
+
+// Stats returns a summary of the cache contents
+func (c *linkCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var s cacheStats
+	now := time.Now()
+	for _, l := range c.Links {
+		s.Entries++
+		if l.Error != "" {
+			s.Failed++
+		}
+		if l.Preview {
+			s.Previews++
+		}
+		if c.expired(l, now) {
+			s.Expired++
+		}
+		if s.Oldest.IsZero() || l.FetchedAt.Before(s.Oldest) {
+			s.Oldest = l.FetchedAt
+		}
+		if l.FetchedAt.After(s.Newest) {
+			s.Newest = l.FetchedAt
+		}
+	}
+
+	return s
+}
+
+// runCacheCommand handles the "cache" sub-command
+func (a app) runCacheCommand(args []string) {
+	if a.Links == nil {
+		log.Fatal().Msg("the link cache is disabled")
+	}
+
+	if len(args) != 1 {
+		log.Fatal().Msg("usage: cache [stats|prune]")
+	}
+
+	switch args[0] {
+	case "stats":
+		s := a.Links.Stats()
+		fmt.Printf("cache file : %s\n", a.Links.path)
+		fmt.Printf("entries    : %d\n", s.Entries)
+		fmt.Printf("previews   : %d\n", s.Previews)
+		fmt.Printf("failed     : %d\n", s.Failed)
+		fmt.Printf("expired    : %d\n", s.Expired)
+		if s.Entries > 0 {
+			fmt.Printf("oldest     : %s\n", s.Oldest.Local().Format(time.RFC3339))
+			fmt.Printf("newest     : %s\n", s.Newest.Local().Format(time.RFC3339))
+		}
+		if fi, err := os.Stat(a.Links.path); err == nil {
+			fmt.Printf("size       : %d bytes\n", fi.Size())
+		}
+	case "prune":
+		removed := a.Links.Prune()
+		if err := a.Links.Save(); err != nil {
+			log.Fatal().Err(err).Str("path", a.Links.path).Msg("error saving link cache")
+		}
+		fmt.Printf("removed %d expired entries from %s\n", removed, a.Links.path)
+	default:
+		log.Fatal().Str("command", args[0]).Msg("unknown cache command, expected stats or prune")
+	}
+}
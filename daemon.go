@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// scheduledDigest is a digest profile run by the daemon
+type scheduledDigest struct {
+	app     app
+	profile profile
+}
+
+// runDaemon runs the scheduled digest profiles until SIGINT or SIGTERM is received.
+// SIGHUP reloads the config file, the previous config is kept if the new one is invalid.
+func (a app) runDaemon(name string) {
+	// the daemon logs what it schedules and runs at the info level, which is hidden by default
+	if zerolog.GlobalLevel() > zerolog.InfoLevel {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	digests, err := a.loadSchedules(name)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to start the daemon")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for _, d := range digests {
+			wg.Add(1)
+			go func(d scheduledDigest) {
+				defer wg.Done()
+				a.schedule(ctx, d)
+			}(d)
+		}
+
+		select {
+		case <-stop:
+			log.Info().Msg("stopping, waiting for running digests to finish")
+			cancel()
+			wg.Wait()
+			return
+		case <-hup:
+			log.Info().Msg("reloading the config file")
+			// wait for running digests so a profile is never run twice at the same time
+			cancel()
+			wg.Wait()
+
+			if err := viper.ReadInConfig(); err != nil {
+				log.Error().Err(err).Msg("error reading the config file, keeping the previous config")
+				continue
+			}
+			reloaded, err := a.loadSchedules(name)
+			if err != nil {
+				log.Error().Err(err).Msg("invalid config, keeping the previous config")
+				continue
+			}
+			digests = reloaded
+		}
+	}
+}
+
+// loadSchedules reads the email server settings and the scheduled profiles from the config file
+func (a app) loadSchedules(name string) ([]scheduledDigest, error) {
+	profiles, err := selectProfiles(name, name == "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.Config.DryRun {
+		if a.SMTP, err = loadSMTPConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	var scheduled []profile
+	for _, p := range profiles {
+		if p.Schedule == "" {
+			log.Warn().Str("profile", p.Name).Msg("digest does not have a schedule, skipping")
+			continue
+		}
+		scheduled = append(scheduled, p)
+	}
+	if len(scheduled) == 0 {
+		return nil, errors.New("none of the digests have a schedule")
+	}
+
+	runners, err := a.prepareProfiles(scheduled)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]scheduledDigest, len(scheduled))
+	for i, p := range scheduled {
+		digests[i] = scheduledDigest{app: runners[i], profile: p}
+	}
+
+	return digests, nil
+}
+
+// schedule runs a digest profile at the times given by its cron expression until ctx is cancelled.
+// A run that was missed while the daemon wasn't running is caught up immediately, multiple missed runs result
+// in a single digest.
+func (a app) schedule(ctx context.Context, d scheduledDigest) {
+	sched, loc, err := d.profile.schedule()
+	if err != nil || sched == nil {
+		return
+	}
+
+	now := time.Now().In(loc)
+	next := sched.Next(now)
+	if last, ok := a.State.LastRun(d.profile.Name); ok && sched.Next(last.In(loc)).Before(now) {
+		log.Info().Str("profile", d.profile.Name).Time("last-run", last).Msg("catching up on a missed run")
+		next = now
+	}
+
+	for {
+		log.Info().Str("profile", d.profile.Name).Time("next-run", next).Msg("scheduled digest")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		d.app.runScheduled(d.profile)
+		if err := a.State.RecordRun(d.profile.Name, next); err != nil {
+			log.Error().Err(err).Str("path", a.Config.StateFile).Msg("error saving state file")
+		}
+
+		next = sched.Next(time.Now().In(loc))
+	}
+}
+
+// runScheduled builds and sends a single digest
+func (a app) runScheduled(p profile) {
+	log.Info().Str("profile", p.Name).Msg("running digest")
+
+	d := a.renderDigest(p, true)
+	if d == nil || a.Config.DryRun {
+		return
+	}
+
+	if err := a.deliver([]renderedDigest{*d}); err != nil {
+		log.Error().Err(err).Str("profile", p.Name).Str("server", a.SMTP.Host).Msg("error connecting to the email server")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// engagementCount is the number of likes plus twice the number of retweets of a tweet. Retweets are counted by the
+// retweeted tweet.
+func engagementCount(t anaconda.Tweet) float64 {
+	if t.RetweetedStatus != nil {
+		t = *t.RetweetedStatus
+	}
+	return float64(t.FavoriteCount + 2*t.RetweetCount)
+}
+
+// engagementScore ranks tweets by their engagement count per 1,000 followers of the author, so tweets of small
+// accounts can compete with those of large accounts in the same timeline. Tweets of authors whose follower count is
+// unknown are scored by their engagement count alone.
+func engagementScore(t anaconda.Tweet) float64 {
+	score := engagementCount(t)
+	if t.RetweetedStatus != nil {
+		t = *t.RetweetedStatus
+	}
+	if t.User.FollowersCount > 0 {
+		score = score * 1000 / float64(t.User.FollowersCount)
+	}
+	return score
+}
+
+// engaging reports whether a tweet has at least --min-favorites likes and --min-retweets retweets.
+// Retweets are measured by the retweeted tweet.
+func (a app) engaging(t anaconda.Tweet) bool {
+	if t.RetweetedStatus != nil {
+		t = *t.RetweetedStatus
+	}
+	return t.FavoriteCount >= a.Config.MinFavorites && t.RetweetCount >= a.Config.MinRetweets
+}
+
+// topTweets keeps the n tweets with the highest engagement score, in their original order. A thread is ranked by
+// its most engaging tweet and kept or dropped as a whole, the threads of the dropped tweets are removed.
+func topTweets(tweets []anaconda.Tweet, threads map[string]digestThread, n int) []anaconda.Tweet {
+	if n <= 0 || len(tweets) <= n {
+		return tweets
+	}
+
+	scores := make([]float64, len(tweets))
+	for i, t := range tweets {
+		scores[i] = engagementScore(t)
+		for _, reply := range threads[t.IdStr].Tweets {
+			if score := engagementScore(reply); score > scores[i] {
+				scores[i] = score
+			}
+		}
+	}
+
+	keep := make(map[int]bool, n)
+	for _, i := range rankTweets(scores)[:n] {
+		keep[i] = true
+	}
+
+	top := make([]anaconda.Tweet, 0, n)
+	for i, t := range tweets {
+		if keep[i] {
+			top = append(top, t)
+		} else {
+			delete(threads, t.IdStr)
+		}
+	}
+	return top
+}
+
+// highlights returns the n tweets with the highest engagement count, highest first. The follower counts of the
+// timelines of a digest aren't comparable (feeds, Bluesky and archives don't provide them), so unlike --top the
+// count isn't normalised. Tweets without any likes or retweets aren't highlighted and a tweet retweeted by several
+// accounts is only highlighted once.
+func highlights(tweets []anaconda.Tweet, n int) []anaconda.Tweet {
+	if n <= 0 {
+		return nil
+	}
+
+	counts := make([]float64, len(tweets))
+	for i, t := range tweets {
+		counts[i] = engagementCount(t)
+	}
+
+	var top []anaconda.Tweet
+	seen := make(map[string]bool)
+	for _, i := range rankTweets(counts) {
+		t := tweets[i]
+		if len(top) >= n || counts[i] == 0 {
+			break
+		}
+
+		content := t
+		if t.RetweetedStatus != nil {
+			content = *t.RetweetedStatus
+		}
+		if link := permalink(content); !seen[link] {
+			seen[link] = true
+			top = append(top, t)
+		}
+	}
+	return top
+}
+
+// rankTweets returns the indices of the scores ordered from highest to lowest. Equal scores keep their order.
+func rankTweets(scores []float64) []int {
+	ranked := make([]int, len(scores))
+	for i := range ranked {
+		ranked[i] = i
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+	return ranked
+}
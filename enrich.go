@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/jakewarren/metascraper"
+	"github.com/rs/zerolog/log"
+)
+
+// linkPreview holds the precomputed information used to render a link in the digest
+type linkPreview struct {
+	URL         string   `json:"url"`
+	FinalURL    string   `json:"final_url"`
+	Images      []string `json:"images"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	// Card holds the embed HTML when the link points to a tweet
+	Card string `json:"card"`
+}
+
+// linkRequest describes a single URL that has to be enriched
+type linkRequest struct {
+	URL string
+	// Preview is set when the metadata of the page is needed in addition to the final URL
+	Preview bool
+}
+
+// collectLinks returns the deduplicated URLs found in the tweets (and the retweeted tweets) in the order they appear
+func collectLinks(tweets []anaconda.Tweet) []linkRequest {
+	var requests []linkRequest
+	index := make(map[string]int)
+
+	add := func(u string, preview bool) {
+		if i, ok := index[u]; ok {
+			requests[i].Preview = requests[i].Preview || preview
+			return
+		}
+		index[u] = len(requests)
+		requests = append(requests, linkRequest{URL: u, Preview: preview})
+	}
+
+	for _, t := range tweets {
+		for _, tweet := range []*anaconda.Tweet{&t, t.RetweetedStatus} {
+			if tweet == nil {
+				continue
+			}
+			for _, match := range textURLs(*tweet) {
+				add(match, false)
+			}
+			for _, u := range tweet.Entities.Urls {
+				add(u.Expanded_url, true)
+			}
+		}
+	}
+
+	return requests
+}
+
+// textURLs returns the URLs in the text of a tweet that aren't covered by an entity, the URL entities are collected
+// with their expanded URL instead. The text is split and unescaped the same way it is when the tweet is rendered, so
+// the URLs match the ones looked up in the digest.
+func textURLs(t anaconda.Tweet) []string {
+	var ranges [][]int
+	add := func(indices []int) {
+		if len(indices) == 2 {
+			ranges = append(ranges, indices)
+		}
+	}
+	for _, u := range t.Entities.Urls {
+		add(u.Indices)
+	}
+	for _, m := range t.Entities.Media {
+		add(m.Indices)
+	}
+	for _, m := range t.Entities.User_mentions {
+		add(m.Indices)
+	}
+	for _, h := range t.Entities.Hashtags {
+		add(h.Indices)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	var urls []string
+	collect := func(s string) {
+		urls = append(urls, urlRE.FindAllString(html.UnescapeString(s), -1)...)
+	}
+	text := []rune(t.FullText)
+	pos := 0
+	for _, r := range ranges {
+		if r[0] < pos || r[1] > len(text) || r[0] >= r[1] {
+			continue
+		}
+		collect(string(text[pos:r[0]]))
+		pos = r[1]
+	}
+	collect(string(text[pos:]))
+
+	return urls
+}
+
+// hostLimiter bounds the number of concurrent requests made to a single host
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &hostLimiter{limit: limit, hosts: make(map[string]chan struct{})}
+}
+
+// acquire blocks until a slot for the host of rawURL is available and returns the function to release it
+func (h *hostLimiter) acquire(ctx context.Context, rawURL string) (func(), error) {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		host = strings.ToLower(u.Host)
+	}
+
+	h.mu.Lock()
+	sem, ok := h.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, h.limit)
+		h.hosts[host] = sem
+	}
+	h.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// enrichLinks resolves and scrapes all links found in the tweets in parallel so that rendering doesn't have
+// to make any network requests
+func (a app) enrichLinks(ctx context.Context, tweets []anaconda.Tweet) map[string]*linkPreview {
+	requests := collectLinks(tweets)
+	previews := make([]*linkPreview, len(requests))
+	hosts := newHostLimiter(a.Config.LinkHostConcurrency)
+
+	workers := a.Config.LinkWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				previews[i] = a.enrichLink(ctx, hosts, requests[i])
+			}
+		}()
+	}
+
+	for i := range requests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	links := make(map[string]*linkPreview, len(previews))
+	for _, p := range previews {
+		links[p.URL] = p
+	}
+
+	return links
+}
+
+// enrichLink unshortens a single link and, if requested, collects the preview metadata for it.
+// Results are served from and stored in the link cache.
+func (a app) enrichLink(ctx context.Context, hosts *hostLimiter, r linkRequest) *linkPreview {
+	if p, ok := a.Links.Get(r); ok {
+		return p
+	}
+
+	p := &linkPreview{URL: r.URL}
+
+	release, err := hosts.acquire(ctx, r.URL)
+	if err != nil {
+		return p
+	}
+	p.FinalURL, err = unshortenURL(ctx, r.URL)
+	release()
+	if err != nil {
+		log.Debug().Err(err).Str("url", r.URL).Msg("error unshortening url")
+		if ctx.Err() == nil {
+			a.Links.Put(r, p, err)
+		}
+		return p
+	}
+
+	if !r.Preview {
+		a.Links.Put(r, p, nil)
+		return p
+	}
+
+	target := r.URL
+	log.Debug().Str("url", target).Msg("fetching image for URL")
+
+	if a.Client != nil && strings.HasPrefix(target, "https://twitter.com/") && strings.Contains(target, "/status/") {
+		var tweetURL string
+		p.Card, tweetURL = a.generateTwitterCard(target)
+		if tweetURL != "" {
+			target = tweetURL
+		}
+	}
+
+	if release, err = hosts.acquire(ctx, target); err != nil {
+		return p
+	}
+	page, metaErr := metascraper.Scrape(target)
+	release()
+	if metaErr != nil {
+		log.Error().Str("url", target).Err(metaErr).Msg("error getting metadata for an url")
+		a.Links.Put(r, p, metaErr)
+		return p
+	}
+
+	p.Title = cleanText(page.Title, 200)
+	for _, m := range page.MetaData() {
+		// opengraph tags use the property attribute rather than name
+		key := m.Name
+		if key == "" {
+			key = m.Property
+		}
+
+		switch key {
+		case "twitter:image", "og:image", "twitter:image:src":
+			if img := resolveURL(target, m.Content); img != "" {
+				p.Images = append(p.Images, img)
+			}
+		case "og:title", "twitter:title":
+			p.Title = cleanText(m.Content, 200)
+		case "description", "og:description", "twitter:description":
+			if p.Description == "" {
+				p.Description = cleanText(m.Content, 500)
+			}
+		}
+	}
+	a.Links.Put(r, p, nil)
+
+	return p
+}
+
+// TODO: make this prettier
+func (a app) generateTwitterCard(tweetURL string) (string, string) {
+	var output string
+
+	log.Debug().Str("url", tweetURL).Msg("generating twitter card")
+
+	v := url.Values{}
+	v.Set("url", tweetURL)
+	v.Set("dnt", "true")
+
+	o, err := a.Client.GetOEmbed(v)
+	if err == nil {
+		output = o.Html
+	} else {
+		log.Error().Err(err).Str("url", tweetURL).Msg("error generating tweet card")
+	}
+
+	return output, tweetURL
+}
+
+var unshortenClient = http.Client{
+	Timeout: 30 * time.Second,
+}
+
+func unshortenURL(ctx context.Context, url string) (string, error) {
+	var output string
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return output, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible;)")
+
+	resp, unshortenErr := unshortenClient.Do(req)
+	if unshortenErr == nil {
+		output = resp.Request.URL.String()
+		resp.Body.Close()
+	}
+	return output, unshortenErr
+}
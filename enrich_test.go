@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+func TestCollectLinks(t *testing.T) {
+	var tweet anaconda.Tweet
+	err := json.Unmarshal([]byte(`{
+		"full_text": "@golang https://example.com/?a=1&amp;b=2 and https://t.co/x",
+		"entities": {
+			"user_mentions": [{"screen_name": "golang", "indices": [0, 7]}],
+			"urls": [{"url": "https://t.co/x", "expanded_url": "https://go.dev/blog", "indices": [45, 59]}]
+		}
+	}`), &tweet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retweet := anaconda.Tweet{FullText: "RT @golang: …", RetweetedStatus: &tweet}
+
+	// the text URL is collected unescaped, as it is looked up when the tweet is rendered, and the shortened URL
+	// covered by an entity only with its expanded URL
+	want := []linkRequest{{URL: "https://example.com/?a=1&b=2"}, {URL: "https://go.dev/blog", Preview: true}}
+	if got := collectLinks([]anaconda.Tweet{tweet, retweet}); !reflect.DeepEqual(got, want) {
+		t.Errorf("collectLinks() = %+v, want %+v", got, want)
+	}
+}
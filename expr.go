@@ -0,0 +1,669 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// exprType is the type of the value of a filter expression
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprNumber
+	exprString
+	exprList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	default:
+		return "list"
+	}
+}
+
+// tweetFields is the tweet a filter expression is evaluated against. The content fields describe the retweeted
+// tweet for retweets, the author fields describe the account that posted the tweet.
+type tweetFields struct {
+	tweet   anaconda.Tweet
+	content anaconda.Tweet
+	now     time.Time
+}
+
+func newTweetFields(t anaconda.Tweet, now time.Time) tweetFields {
+	f := tweetFields{tweet: t, content: t, now: now}
+	if t.RetweetedStatus != nil {
+		f.content = *t.RetweetedStatus
+	}
+	return f
+}
+
+// exprField is a field of a tweet that can be used in filter expressions
+type exprField struct {
+	Name string
+	Type exprType
+	Doc  string
+	get  func(f tweetFields) interface{}
+}
+
+// exprFields are the fields available to filter expressions, in the order they are documented
+var exprFields = []exprField{
+	{"author", exprString, "screen name of the account that posted the tweet (the retweeter for retweets)", func(f tweetFields) interface{} { return f.tweet.User.ScreenName }},
+	{"author_name", exprString, "display name of the account that posted the tweet", func(f tweetFields) interface{} { return f.tweet.User.Name }},
+	{"author_followers", exprNumber, "number of followers of the account that posted the tweet (0 when unknown)", func(f tweetFields) interface{} { return float64(f.tweet.User.FollowersCount) }},
+	{"author_verified", exprBool, "whether the account that posted the tweet is verified", func(f tweetFields) interface{} { return f.tweet.User.Verified }},
+	{"original_author", exprString, "screen name of the author of the retweeted tweet, the same as author for other tweets", func(f tweetFields) interface{} { return f.content.User.ScreenName }},
+	{"text", exprString, "text of the tweet", func(f tweetFields) interface{} { return html.UnescapeString(f.content.FullText) }},
+	{"lang", exprString, "language detected by the network, for example en (empty when unknown)", func(f tweetFields) interface{} { return f.content.Lang }},
+	{"source", exprString, "name of the client used to post the tweet, for example Twitter Web App (empty when unknown)", func(f tweetFields) interface{} {
+		return strings.TrimSpace(html.UnescapeString(textFromHTML(f.content.Source).Text))
+	}},
+	{"favorites", exprNumber, "number of likes, also available as likes", func(f tweetFields) interface{} { return float64(f.content.FavoriteCount) }},
+	{"retweets", exprNumber, "number of retweets", func(f tweetFields) interface{} { return float64(f.content.RetweetCount) }},
+	{"hashtags", exprList, "hashtags without the #", func(f tweetFields) interface{} {
+		var tags []string
+		for _, h := range f.content.Entities.Hashtags {
+			tags = append(tags, h.Text)
+		}
+		return tags
+	}},
+	{"mentions", exprList, "screen names of the mentioned accounts without the @", func(f tweetFields) interface{} {
+		var names []string
+		for _, m := range f.content.Entities.User_mentions {
+			names = append(names, m.Screen_name)
+		}
+		return names
+	}},
+	{"urls", exprList, "expanded URLs of the links", func(f tweetFields) interface{} { return f.urls() }},
+	{"domains", exprList, "host names of the links", func(f tweetFields) interface{} {
+		var hosts []string
+		for _, u := range f.urls() {
+			if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+				hosts = append(hosts, strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www."))
+			}
+		}
+		return hosts
+	}},
+	{"media_count", exprNumber, "number of attached photos and videos", func(f tweetFields) interface{} { return float64(f.mediaCount()) }},
+	{"has_media", exprBool, "whether photos or videos are attached", func(f tweetFields) interface{} { return f.mediaCount() > 0 }},
+	{"has_links", exprBool, "whether the tweet links to something", func(f tweetFields) interface{} { return len(f.urls()) > 0 }},
+	{"is_retweet", exprBool, "whether the tweet is a retweet", func(f tweetFields) interface{} { return f.tweet.RetweetedStatus != nil }},
+	{"is_reply", exprBool, "whether the tweet is a reply, including replies to the author's own tweets", func(f tweetFields) interface{} { return isReply(f.content) }},
+	{"is_self_reply", exprBool, "whether the tweet replies to a tweet of the same author, as in a thread", func(f tweetFields) interface{} {
+		return isReply(f.content) && f.content.InReplyToUserID == f.content.User.Id
+	}},
+	{"reply_to", exprString, "screen name of the account the tweet replies to (empty for other tweets)", func(f tweetFields) interface{} { return f.content.InReplyToScreenName }},
+	{"is_quote", exprBool, "whether the tweet quotes another tweet", func(f tweetFields) interface{} {
+		return f.content.QuotedStatus != nil || f.content.QuotedStatusIdStr != ""
+	}},
+	{"age", exprNumber, "time since the tweet was posted, compared with durations like 6h or 2d", func(f tweetFields) interface{} {
+		created, err := f.tweet.CreatedAtTime()
+		if err != nil {
+			return float64(0)
+		}
+		return f.now.Sub(created).Seconds()
+	}},
+}
+
+// exprAliases are alternative names of fields
+var exprAliases = map[string]string{
+	"likes": "favorites",
+}
+
+func (f tweetFields) urls() []string {
+	var urls []string
+	for _, u := range f.content.Entities.Urls {
+		urls = append(urls, u.Expanded_url)
+	}
+	return urls
+}
+
+func (f tweetFields) mediaCount() int {
+	if n := len(f.content.ExtendedEntities.Media); n > 0 {
+		return n
+	}
+	return len(f.content.Entities.Media)
+}
+
+// lookupField returns the field with the given name or alias
+func lookupField(name string) *exprField {
+	if alias, ok := exprAliases[name]; ok {
+		name = alias
+	}
+	for i := range exprFields {
+		if exprFields[i].Name == name {
+			return &exprFields[i]
+		}
+	}
+	return nil
+}
+
+// filterExpr is a compiled filter expression like `favorites > 100 && !is_retweet`
+type filterExpr struct {
+	source string
+	root   exprNode
+}
+
+// compileFilter parses a filter expression, which has to evaluate to a bool
+func compileFilter(src string) (*filterExpr, error) {
+	p := exprParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", src, err)
+	}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf(p.peek(), "unexpected %s", p.peek())
+	}
+	if err == nil && root.typ() != exprBool {
+		err = fmt.Errorf("the filter is a %s, expected a condition", root.typ())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", src, err)
+	}
+	return &filterExpr{source: src, root: root}, nil
+}
+
+// matches reports whether a tweet passes the filter
+func (e *filterExpr) matches(f tweetFields) bool {
+	return e.root.eval(f).(bool)
+}
+
+// explain lists the conditions of the filter with their result and the values of the fields they use
+func (e *filterExpr) explain(f tweetFields) []string {
+	var lines []string
+	var walk func(n exprNode)
+	walk = func(n exprNode) {
+		if l, ok := n.(logicNode); ok {
+			walk(l.left)
+			walk(l.right)
+			return
+		}
+		var values []string
+		for _, field := range exprFieldsOf(n) {
+			values = append(values, field.Name+" = "+formatValue(field, field.get(f)))
+		}
+		line := fmt.Sprintf("%-5t  %s", n.eval(f).(bool), n)
+		if len(values) > 0 {
+			line += "  (" + strings.Join(values, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	walk(e.root)
+	return lines
+}
+
+// exprFieldsOf returns the fields used by an expression
+func exprFieldsOf(n exprNode) []*exprField {
+	switch n := n.(type) {
+	case fieldNode:
+		return []*exprField{n.field}
+	case notNode:
+		return exprFieldsOf(n.x)
+	case logicNode:
+		return append(exprFieldsOf(n.left), exprFieldsOf(n.right)...)
+	case compareNode:
+		return append(exprFieldsOf(n.left), exprFieldsOf(n.right)...)
+	}
+	return nil
+}
+
+// formatValue formats the value of a field for the output of filter test
+func formatValue(field *exprField, v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		if field.Name == "age" {
+			return (time.Duration(v) * time.Second).String()
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		// long texts would bury the other values
+		if runes := []rune(v); len(runes) > 80 {
+			v = string(runes[:80]) + "…"
+		}
+		return strconv.Quote(v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// exprNode is a node of a parsed filter expression. Nodes are type checked when they're parsed, so eval doesn't
+// fail.
+type exprNode interface {
+	typ() exprType
+	eval(f tweetFields) interface{}
+	String() string
+}
+
+type literalNode struct {
+	t    exprType
+	val  interface{}
+	text string
+}
+
+func (n literalNode) typ() exprType                  { return n.t }
+func (n literalNode) eval(f tweetFields) interface{} { return n.val }
+func (n literalNode) String() string                 { return n.text }
+
+type fieldNode struct {
+	field *exprField
+}
+
+func (n fieldNode) typ() exprType                  { return n.field.Type }
+func (n fieldNode) eval(f tweetFields) interface{} { return n.field.get(f) }
+func (n fieldNode) String() string                 { return n.field.Name }
+
+type notNode struct {
+	x exprNode
+}
+
+func (n notNode) typ() exprType                  { return exprBool }
+func (n notNode) eval(f tweetFields) interface{} { return !n.x.eval(f).(bool) }
+func (n notNode) String() string {
+	if _, ok := n.x.(logicNode); ok {
+		return "!(" + n.x.String() + ")"
+	}
+	if _, ok := n.x.(compareNode); ok {
+		return "!(" + n.x.String() + ")"
+	}
+	return "!" + n.x.String()
+}
+
+type logicNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n logicNode) typ() exprType { return exprBool }
+func (n logicNode) eval(f tweetFields) interface{} {
+	if n.op == "&&" {
+		return n.left.eval(f).(bool) && n.right.eval(f).(bool)
+	}
+	return n.left.eval(f).(bool) || n.right.eval(f).(bool)
+}
+func (n logicNode) String() string {
+	side := func(x exprNode) string {
+		if l, ok := x.(logicNode); ok && l.op != n.op {
+			return "(" + l.String() + ")"
+		}
+		return x.String()
+	}
+	return side(n.left) + " " + n.op + " " + side(n.right)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+	// re is the compiled pattern of =~ and !~
+	re *regexp.Regexp
+}
+
+func (n compareNode) typ() exprType { return exprBool }
+func (n compareNode) String() string {
+	return n.left.String() + " " + n.op + " " + n.right.String()
+}
+
+func (n compareNode) eval(f tweetFields) interface{} {
+	l, r := n.left.eval(f), n.right.eval(f)
+	switch n.op {
+	case "==":
+		return equalValues(l, r)
+	case "!=":
+		return !equalValues(l, r)
+	case "<":
+		return l.(float64) < r.(float64)
+	case "<=":
+		return l.(float64) <= r.(float64)
+	case ">":
+		return l.(float64) > r.(float64)
+	case ">=":
+		return l.(float64) >= r.(float64)
+	case "=~", "!~":
+		matched := false
+		for _, s := range stringValues(l) {
+			matched = matched || n.re.MatchString(s)
+		}
+		return matched == (n.op == "=~")
+	case "contains":
+		if s, ok := l.(string); ok {
+			return strings.Contains(strings.ToLower(s), strings.ToLower(r.(string)))
+		}
+		return listContains(l.([]string), r.(string))
+	case "in":
+		return listContains(r.([]string), l.(string))
+	}
+	return false
+}
+
+// equalValues compares two values of the same type, strings are compared case-insensitively
+func equalValues(l, r interface{}) bool {
+	if s, ok := l.(string); ok {
+		return strings.EqualFold(s, r.(string))
+	}
+	return l == r
+}
+
+func stringValues(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	return v.([]string)
+}
+
+func listContains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+	// num is the value of a number, durations are converted to seconds
+	num float64
+	// str is the unquoted value of a string
+	str string
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprOperators are the operators of the filter language, longest first
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "!", "<", ">", "(", ")", "[", "]", ","}
+
+// exprUnits are the units of duration literals in seconds
+var exprUnits = map[string]float64{"s": 1, "m": 60, "h": 3600, "d": 24 * 3600, "w": 7 * 24 * 3600}
+
+// exprParser is a recursive descent parser of filter expressions:
+//
+//	or         = and { ("||" | "or") and }
+//	and        = not { ("&&" | "and") not }
+//	not        = ("!" | "not") not | comparison
+//	comparison = operand [ op operand ]
+//	operand    = field | number | duration | string | true | false | list | "(" or ")"
+type exprParser struct {
+	src    string
+	tokens []exprToken
+	next   int
+}
+
+func (p *exprParser) errorf(t exprToken, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+// lex splits the source into tokens
+func (p *exprParser) lex() error {
+	src := p.src
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				b.WriteByte(src[i])
+			}
+			if i >= len(src) {
+				return p.errorf(exprToken{pos: start}, "unterminated string")
+			}
+			i++
+			p.tokens = append(p.tokens, exprToken{kind: tokString, text: src[start:i], pos: start, str: b.String()})
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			num, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return p.errorf(exprToken{pos: start}, "invalid number %q", src[start:i])
+			}
+			unitStart := i
+			for i < len(src) && unicode.IsLetter(rune(src[i])) {
+				i++
+			}
+			if unit := src[unitStart:i]; unit != "" {
+				seconds, ok := exprUnits[unit]
+				if !ok {
+					return p.errorf(exprToken{pos: unitStart}, "invalid duration unit %q, expected s, m, h, d or w", unit)
+				}
+				num *= seconds
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokNumber, text: src[start:i], pos: start, num: num})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return p.errorf(exprToken{pos: i}, "unexpected character %q", c)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, exprToken{kind: tokEOF, pos: len(src)})
+	return nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token if it is one of the operators or keywords
+func (p *exprParser) accept(texts ...string) (exprToken, bool) {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokIdent {
+		return t, false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.next++
+			return t, true
+		}
+	}
+	return t, false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogic("||", "or", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogic("&&", "and", p.parseNot)
+}
+
+func (p *exprParser) parseLogic(op, keyword string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept(op, keyword)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		for _, side := range []exprNode{left, right} {
+			if side.typ() != exprBool {
+				return nil, p.errorf(t, "%s needs conditions on both sides, %s is a %s", t.text, side, side.typ())
+			}
+		}
+		left = logicNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	t, ok := p.accept("!", "not")
+	if !ok {
+		return p.parseComparison()
+	}
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != exprBool {
+		return nil, p.errorf(t, "%s needs a condition, %s is a %s", t.text, x, x.typ())
+	}
+	return notNode{x: x}, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "!~", "matches", "contains", "in")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	n := compareNode{op: t.text, left: left, right: right}
+	if n.op == "matches" {
+		n.op = "=~"
+	}
+	lt, rt := left.typ(), right.typ()
+	mismatch := p.errorf(t, "%s can't compare %s (%s) with %s (%s)", t.text, left, lt, right, rt)
+	switch n.op {
+	case "==", "!=":
+		if lt != rt || lt == exprList {
+			return nil, mismatch
+		}
+	case "<", "<=", ">", ">=":
+		if lt != exprNumber || rt != exprNumber {
+			return nil, mismatch
+		}
+	case "=~", "!~":
+		lit, ok := right.(literalNode)
+		if lt == exprNumber || lt == exprBool || !ok || rt != exprString {
+			return nil, p.errorf(t, "%s needs a string or list field on the left and a quoted regular expression on the right", t.text)
+		}
+		if n.re, err = regexp.Compile(`(?i)` + lit.val.(string)); err != nil {
+			return nil, p.errorf(t, "invalid regex %s: %v", lit, err)
+		}
+	case "contains":
+		if lt != exprString && lt != exprList || rt != exprString {
+			return nil, mismatch
+		}
+	case "in":
+		if lt != exprString || rt != exprList {
+			return nil, mismatch
+		}
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	t := p.peek()
+	p.next++
+	switch t.kind {
+	case tokNumber:
+		return literalNode{t: exprNumber, val: t.num, text: t.text}, nil
+	case tokString:
+		return literalNode{t: exprString, val: t.str, text: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return literalNode{t: exprBool, val: t.text == "true", text: t.text}, nil
+		}
+		if field := lookupField(t.text); field != nil {
+			return fieldNode{field: field}, nil
+		}
+		return nil, p.errorf(t, "unknown field %q, run \"filter fields\" to list the fields", t.text)
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, p.errorf(p.peek(), "expected \")\", found %s", p.peek())
+			}
+			return x, nil
+		case "[":
+			return p.parseList()
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// parseList parses a list of strings like ["en", "de"] after the opening bracket
+func (p *exprParser) parseList() (exprNode, error) {
+	var items, texts []string
+	for {
+		if _, ok := p.accept("]"); ok {
+			break
+		}
+		if len(items) > 0 {
+			if _, ok := p.accept(","); !ok {
+				return nil, p.errorf(p.peek(), "expected \",\" or \"]\", found %s", p.peek())
+			}
+		}
+		t := p.peek()
+		if t.kind != tokString {
+			return nil, p.errorf(t, "lists can only contain quoted strings, found %s", t)
+		}
+		p.next++
+		items = append(items, t.str)
+		texts = append(texts, t.text)
+	}
+	return literalNode{t: exprList, val: items, text: "[" + strings.Join(texts, ", ") + "]"}, nil
+}
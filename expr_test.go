@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+func TestExprLex(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    []exprToken
+		wantErr string
+	}{
+		{
+			src: `favorites>=100&&!is_retweet`,
+			want: []exprToken{
+				{kind: tokIdent, text: "favorites", pos: 0},
+				{kind: tokOp, text: ">=", pos: 9},
+				{kind: tokNumber, text: "100", pos: 11, num: 100},
+				{kind: tokOp, text: "&&", pos: 14},
+				{kind: tokOp, text: "!", pos: 16},
+				{kind: tokIdent, text: "is_retweet", pos: 17},
+			},
+		},
+		{
+			src: `age < 1.5h`,
+			want: []exprToken{
+				{kind: tokIdent, text: "age", pos: 0},
+				{kind: tokOp, text: "<", pos: 4},
+				{kind: tokNumber, text: "1.5h", pos: 6, num: 5400},
+			},
+		},
+		{src: `text == "open`, wantErr: "column 9: unterminated string"},
+		{src: `age < 2y`, wantErr: `column 8: invalid duration unit "y"`},
+		{src: `retweets > 1..2`, wantErr: `column 12: invalid number "1..2"`},
+		{src: `author = "x"`, wantErr: `column 8: unexpected character '='`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p := exprParser{src: tt.src}
+			err := p.lex()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("lex() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lex() error = %v", err)
+			}
+
+			want := append(tt.want, exprToken{kind: tokEOF, pos: len(tt.src)})
+			if len(p.tokens) != len(want) {
+				t.Fatalf("lex() = %+v, want %+v", p.tokens, want)
+			}
+			for i := range want {
+				if p.tokens[i] != want[i] {
+					t.Errorf("token %d = %+v, want %+v", i, p.tokens[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    string
+		wantErr string
+	}{
+		{src: `favorites > 100`, want: `favorites > 100`},
+		{src: `likes > 100`, want: `favorites > 100`},
+		{src: `not is_retweet and (lang == "en" or lang == "de")`, want: `!is_retweet && (lang == "en" || lang == "de")`},
+		{src: `favorites > 1 || retweets > 1 && has_media`, want: `favorites > 1 || (retweets > 1 && has_media)`},
+		{src: `favorites`, wantErr: "the filter is a number, expected a condition"},
+		{src: `favorites == "many"`, wantErr: `column 11: == can't compare favorites (number) with "many" (string)`},
+		{src: `text =~ author`, wantErr: "=~ needs a string or list field on the left and a quoted regular expression on the right"},
+		{src: `text =~ "("`, wantErr: `invalid regex "("`},
+		{src: `lang in ["en", 1]`, wantErr: `lists can only contain quoted strings, found "1"`},
+		{src: `favorites && has_media`, wantErr: "&& needs conditions on both sides, favorites is a number"},
+		{src: `has_media has_links`, wantErr: `column 11: unexpected "has_links"`},
+		{src: ``, wantErr: "unexpected end of filter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := compileFilter(tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("compileFilter() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compileFilter() error = %v", err)
+			}
+			if got := e.root.String(); got != tt.want {
+				t.Errorf("compileFilter() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterExprMatches(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tweet := anaconda.Tweet{
+		FullText:      "Go 1.20 &amp; generics #golang",
+		CreatedAt:     now.Add(-2 * time.Hour).Format(time.RubyDate),
+		Lang:          "en",
+		FavoriteCount: 150,
+		RetweetCount:  5,
+		User:          anaconda.User{Id: 1, ScreenName: "golang", FollowersCount: 1000},
+	}
+	tweet.Entities.Hashtags = []hashtagEntity{{Text: "golang"}}
+	tweet.Entities.Urls = []urlEntity{{Expanded_url: "https://www.Example.com/post"}}
+	retweet := anaconda.Tweet{CreatedAt: tweet.CreatedAt, User: anaconda.User{Id: 2, ScreenName: "gopher"}, RetweetedStatus: &tweet}
+
+	tests := []struct {
+		src   string
+		tweet anaconda.Tweet
+		want  bool
+	}{
+		{src: `favorites > 100 && !is_retweet`, tweet: tweet, want: true},
+		{src: `favorites > 100 && !is_retweet`, tweet: retweet, want: false},
+		{src: `likes >= 150 and retweets < 5`, tweet: tweet, want: false},
+		{src: `author == "golang" || original_author == "golang"`, tweet: retweet, want: true},
+		{src: `text contains "& GENERICS"`, tweet: tweet, want: true},
+		{src: `text =~ "^go [0-9.]+"`, tweet: tweet, want: true},
+		{src: `hashtags contains "GoLang"`, tweet: tweet, want: true},
+		{src: `domains contains "example.com"`, tweet: retweet, want: true},
+		{src: `lang in ["de", "EN"]`, tweet: tweet, want: true},
+		{src: `age < 3h && age > 90m`, tweet: tweet, want: true},
+		{src: `has_links && !has_media`, tweet: tweet, want: true},
+		{src: `not (is_reply or is_quote)`, tweet: tweet, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := compileFilter(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.matches(newTweetFields(tt.tweet, now)); got != tt.want {
+				t.Errorf("matches(@%s) = %t, want %t", tt.tweet.User.ScreenName, got, tt.want)
+			}
+		})
+	}
+}
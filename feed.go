@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html/charset"
+)
+
+// maximum size of a feed document
+const maxFeedSize = 10 << 20
+
+// feedClient downloads RSS and Atom feeds
+type feedClient struct {
+	http *http.Client
+}
+
+func newFeedClient() *feedClient {
+	return &feedClient{http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// feedDocument is the root element of an RSS 2.0, RSS 1.0 or Atom feed
+type feedDocument struct {
+	// RSS
+	Channel struct {
+		Title string     `xml:"title"`
+		Links []feedLink `xml:"link"`
+		Image struct {
+			URL string `xml:"url"`
+		} `xml:"image"`
+		Items []feedItem `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 places the items next to the channel
+	Items []feedItem `xml:"item"`
+
+	// Atom
+	Title   string     `xml:"title"`
+	Links   []feedLink `xml:"link"`
+	Icon    string     `xml:"icon"`
+	Logo    string     `xml:"logo"`
+	Author  feedPerson `xml:"author"`
+	Entries []feedItem `xml:"entry"`
+}
+
+// feedItem is an RSS item or an Atom entry
+type feedItem struct {
+	Title string     `xml:"title"`
+	Links []feedLink `xml:"link"`
+	ID    string     `xml:"id"`
+	GUID  string     `xml:"guid"`
+
+	PubDate   string `xml:"pubDate"`
+	Date      string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+
+	// Author is an e-mail address in RSS and a person in Atom
+	Author  feedPerson `xml:"author"`
+	Creator string     `xml:"http://purl.org/dc/elements/1.1/ creator"`
+
+	Description string `xml:"description"`
+	Encoded     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	// content and summary are qualified so they don't match media:content
+	Content feedText `xml:"http://www.w3.org/2005/Atom content"`
+	Summary feedText `xml:"http://www.w3.org/2005/Atom summary"`
+
+	Enclosures []feedMedia `xml:"enclosure"`
+	Media      []feedMedia `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnails []feedMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Group      struct {
+		Media      []feedMedia `xml:"http://search.yahoo.com/mrss/ content"`
+		Thumbnails []feedMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	} `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+// feedLink is an RSS link, which holds the URL as text, or an Atom link, which holds it in href
+type feedLink struct {
+	XMLName xml.Name
+	Href    string `xml:"href,attr"`
+	Rel     string `xml:"rel,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type feedPerson struct {
+	Name  string `xml:"name"`
+	URI   string `xml:"uri"`
+	Email string `xml:",chardata"`
+}
+
+// feedText is Atom content, which is text, escaped HTML or inline XHTML
+type feedText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+type feedMedia struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+}
+
+// html returns the content as HTML
+func (t feedText) html() string {
+	switch t.Type {
+	case "html", "text/html":
+		return t.Text
+	case "xhtml", "application/xhtml+xml":
+		return t.Inner
+	default:
+		return html.EscapeString(t.Text)
+	}
+}
+
+// image reports whether the media is an image
+func (m feedMedia) image() bool {
+	return m.Medium == "image" || strings.HasPrefix(m.Type, "image/")
+}
+
+// feedSource retrieves the entries of an RSS or Atom feed, such as the feeds published by Nitter and RSSHub
+type feedSource struct {
+	app    app
+	client *feedClient
+	source timelineSource
+}
+
+// Page downloads the feed, retrying according to the retry policy. Feeds aren't paginated, so all the entries newer
+// than sinceID are returned on the first page.
+func (f feedSource) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	a, s := f.app, f.source
+
+	var doc feedDocument
+	err := a.Config.Retry.do(ctx, "feed "+s.Name, func() error {
+		doc = feedDocument{}
+		return f.client.get(ctx, s.Name, &doc)
+	})
+	log.Debug().Int("tweet-count", len(doc.items())).Str("source", s.String()).Msg("pulled down feed entries")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var tweets []anaconda.Tweet
+	for _, item := range doc.items() {
+		tweet := doc.convert(item, s.Name)
+		// the IDs of undated entries aren't ordered, so they can't be compared with the last delivered entry
+		if created, _ := tweet.CreatedAtTime(); sinceID > 0 && (tweet.Id <= sinceID || created.IsZero()) {
+			continue
+		}
+		tweets = append(tweets, tweet)
+	}
+	// feeds aren't necessarily sorted, the digest expects the newest entries first
+	sort.SliceStable(tweets, func(i, j int) bool { return tweets[i].Id > tweets[j].Id })
+
+	return tweets, "", nil
+}
+
+// get downloads and parses a feed. Unsuccessful responses are returned as an *httpError.
+func (c *feedClient) get(ctx context.Context, rawURL string, doc *feedDocument) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, */*;q=0.8")
+	req.Header.Set("User-Agent", "tweetdigest (+https://github.com/jakewarren/tweetdigest)")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newHTTPError(resp)
+	}
+
+	d := xml.NewDecoder(io.LimitReader(resp.Body, maxFeedSize))
+	d.CharsetReader = charset.NewReaderLabel
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	return d.Decode(doc)
+}
+
+// items returns the items of an RSS feed or the entries of an Atom feed
+func (doc feedDocument) items() []feedItem {
+	items := append(doc.Channel.Items, doc.Items...)
+	return append(items, doc.Entries...)
+}
+
+// feedLinkURL returns the URL of the page a feed or an item links to
+func feedLinkURL(links []feedLink) string {
+	for _, l := range links {
+		switch {
+		case l.Href == "" && strings.TrimSpace(l.Text) != "":
+			return strings.TrimSpace(l.Text)
+		case l.Href != "" && (l.Rel == "" || l.Rel == "alternate"):
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// nitterPrefixRE matches the prefixes Nitter adds to the titles of retweets and replies
+var nitterPrefixRE = regexp.MustCompile(`^(RT by|R to) @([A-Za-z0-9_]+): `)
+
+// feedTimeLayouts are the layouts used by the dates in feeds, RFC 822 in RSS and RFC 3339 in Atom
+var feedTimeLayouts = []string{
+	time.RFC1123Z, time.RFC1123, time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700", "2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700", "2006-01-02T15:04:05", "2006-01-02",
+}
+
+// feedTime parses the first date of an item that is set
+func feedTime(dates ...string) time.Time {
+	for _, d := range dates {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		for _, layout := range feedTimeLayouts {
+			if t, err := time.Parse(layout, d); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// convert maps a feed item into the model consumed by the templates. Nitter retweets are mapped onto retweets of
+// the original author and Nitter replies onto replies.
+func (doc feedDocument) convert(item feedItem, feedURL string) anaconda.Tweet {
+	created := feedTime(item.Published, item.PubDate, item.Date, item.Updated)
+	link := feedLinkURL(item.Links)
+	if link == "" && isURL(item.GUID) {
+		link = item.GUID
+	}
+	if link == "" && isURL(item.ID) {
+		link = item.ID
+	}
+	if link != "" {
+		link = resolveURL(feedURL, link)
+	}
+
+	owner := doc.owner(feedURL)
+	author := doc.author(item, link)
+	if author.ScreenName == "" || strings.EqualFold(author.ScreenName, owner.ScreenName) {
+		author = owner
+	}
+
+	title := strings.TrimSpace(html.UnescapeString(item.Title))
+	var retweet bool
+	var replyTo string
+	if m := nitterPrefixRE.FindStringSubmatch(title); m != nil {
+		title = title[len(m[0]):]
+		if m[1] == "RT by" {
+			retweet = true
+		} else {
+			replyTo = m[2]
+		}
+	}
+
+	body := item.Encoded
+	if body == "" {
+		body = item.Content.html()
+	}
+	if strings.TrimSpace(body) == "" {
+		body = item.Description
+	}
+	if strings.TrimSpace(body) == "" {
+		body = item.Summary.html()
+	}
+	content := textFromHTML(body)
+	// blog posts have a title that isn't part of the content, Nitter repeats the text of the tweet as the title
+	if title != "" && !strings.HasPrefix(collapseSpace(html.UnescapeString(content.Text)), titlePrefix(title)) {
+		content = textFromHTML("<p>" + html.EscapeString(title) + "</p>" + body)
+	}
+
+	id := unixMilli(created)
+	if created.IsZero() {
+		// undated entries still need an ID of their own
+		key := strings.TrimSpace(item.GUID)
+		if key == "" {
+			key = strings.TrimSpace(item.ID)
+		}
+		if key == "" {
+			key = link
+		}
+		id = hashID(key)
+	}
+
+	tweet := anaconda.Tweet{
+		Id:        id,
+		IdStr:     link,
+		FullText:  content.Text,
+		Text:      content.Text,
+		CreatedAt: createdAt(created),
+		User:      author,
+	}
+	tweet.Entities.Urls = content.Urls
+	tweet.Entities.User_mentions = content.Mentions
+
+	for _, img := range content.Images {
+		tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(img, "photo"))
+	}
+	media := append(append(item.Enclosures, item.Media...), item.Group.Media...)
+	for _, l := range item.Links {
+		if l.Rel == "enclosure" {
+			media = append(media, feedMedia{URL: l.Href, Type: l.Type})
+		}
+	}
+	thumbnails := append(item.Thumbnails, item.Group.Thumbnails...)
+	for _, m := range media {
+		if m.image() {
+			thumbnails = append(thumbnails, m)
+		} else {
+			// audio and video can't be embedded in an email, so link to them instead
+			appendURL(&tweet, resolveURL(feedURL, m.URL))
+		}
+	}
+	for _, m := range thumbnails {
+		if src := safeURL(resolveURL(feedURL, m.URL)); src != "" && !hasMedia(tweet, src) {
+			tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(src, "photo"))
+		}
+	}
+
+	// the feed doesn't say which tweet is replied to, only the account
+	if replyTo != "" {
+		tweet.InReplyToScreenName = replyTo
+		tweet.InReplyToUserID = hashID(strings.ToLower(replyTo))
+	}
+
+	if retweet {
+		original := tweet
+		tweet.User = owner
+		tweet.FullText = "RT @" + original.User.ScreenName + ": " + original.FullText
+		tweet.Text = tweet.FullText
+		tweet.Entities = anaconda.Entities{}
+		tweet.ExtendedEntities = anaconda.Entities{}
+		tweet.RetweetedStatus = &original
+	}
+
+	return tweet
+}
+
+// owner returns the account that publishes the feed
+func (doc feedDocument) owner(feedURL string) anaconda.User {
+	title := strings.TrimSpace(doc.Channel.Title)
+	if title == "" {
+		title = strings.TrimSpace(doc.Title)
+	}
+	home := feedLinkURL(doc.Channel.Links)
+	if home == "" {
+		home = feedLinkURL(doc.Links)
+	}
+	avatar := doc.Channel.Image.URL
+	if avatar == "" {
+		avatar = doc.Icon
+	}
+	if avatar == "" {
+		avatar = doc.Logo
+	}
+
+	u := anaconda.User{
+		Name:                 title,
+		ScreenName:           title,
+		IdStr:                resolveURL(feedURL, home),
+		ProfileImageURL:      resolveURL(feedURL, avatar),
+		ProfileImageUrlHttps: resolveURL(feedURL, avatar),
+	}
+	if doc.Author.Name != "" {
+		u.Name, u.ScreenName = doc.Author.Name, doc.Author.Name
+	}
+	// Nitter titles the feed "Name / @screen_name"
+	if i := strings.LastIndex(title, " / @"); i >= 0 {
+		u.Name, u.ScreenName = title[:i], title[i+len(" / @"):]
+	}
+	if u.IdStr == "" {
+		u.IdStr = feedURL
+	}
+	u.Id = hashID(strings.ToLower(u.ScreenName))
+
+	return u
+}
+
+// author returns the author of an item. Nitter uses the @screen_name of the author of the tweet as the creator
+// and links to the tweet below the profile of the author.
+func (doc feedDocument) author(item feedItem, link string) anaconda.User {
+	name := strings.TrimSpace(item.Creator)
+	if name == "" {
+		name = strings.TrimSpace(item.Author.Name)
+	}
+	if name == "" {
+		// RSS authors are given as "email (name)"
+		name = strings.TrimSpace(item.Author.Email)
+		if i, j := strings.Index(name, "("), strings.LastIndex(name, ")"); i >= 0 && j > i {
+			name = strings.TrimSpace(name[i+1 : j])
+		}
+	}
+	u := anaconda.User{Name: name, ScreenName: name, IdStr: item.Author.URI}
+
+	if strings.HasPrefix(name, "@") {
+		u.Name = name[1:]
+		u.ScreenName = name[1:]
+		if i := strings.Index(link, "/"+u.ScreenName+"/status/"); i >= 0 {
+			u.IdStr = link[:i+1+len(u.ScreenName)]
+		}
+	}
+	if !isURL(u.IdStr) {
+		if p, err := url.Parse(link); err == nil && p.Host != "" {
+			u.IdStr = p.Scheme + "://" + p.Host + "/"
+		}
+	}
+	u.Id = hashID(strings.ToLower(u.ScreenName))
+
+	return u
+}
+
+// titlePrefix returns the start of a title, which is compared with the content. Titles that repeat the content
+// are often shortened.
+func titlePrefix(title string) string {
+	r := []rune(collapseSpace(strings.TrimSuffix(title, "…")))
+	if len(r) > 30 {
+		r = r[:30]
+	}
+	return string(r)
+}
+
+// collapseSpace replaces runs of whitespace with a single space
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// hasMedia reports whether an image is already attached to the tweet
+func hasMedia(t anaconda.Tweet, src string) bool {
+	for _, m := range t.ExtendedEntities.Media {
+		if m.Media_url_https == src {
+			return true
+		}
+	}
+	return false
+}
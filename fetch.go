@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchTimelines retrieves the timelines of all digest entries using a bounded pool of workers.
+// The results are returned in the same order as the entries were given.
+func (a app) fetchTimelines(ctx context.Context, users []string) []timelineResult {
+	results := make([]timelineResult, len(users))
+
+	workers := a.Config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(users) {
+		workers = len(users)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = a.getTweets(ctx, users[i])
+			}
+		}()
+	}
+
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
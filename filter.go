@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// filterRules are the keyword and regular expression rules of the command line, a digest profile or an account.
+// Rules are case-insensitive and applied to the text, the expanded URLs and the hashtags of a tweet.
+type filterRules struct {
+	// a tweet has to match one of the include rules, if there are any
+	IncludeKeywords []string `mapstructure:"include_keywords"`
+	IncludeRegex    []string `mapstructure:"include_regex"`
+	// a tweet that matches one of the exclude rules is dropped
+	ExcludeKeywords []string `mapstructure:"exclude_keywords"`
+	ExcludeRegex    []string `mapstructure:"exclude_regex"`
+	// WholeWords only matches keywords that aren't part of a longer word
+	WholeWords bool `mapstructure:"whole_words"`
+	// Expression is a filter expression a tweet has to match, see compileFilter
+	Expression string `mapstructure:"filter"`
+}
+
+// ruleSet is a compiled set of filterRules
+type ruleSet struct {
+	include, exclude []filterPattern
+	expr             *filterExpr
+}
+
+// filterPattern is a compiled keyword or regular expression, label describes it in the output of filter test
+type filterPattern struct {
+	re    *regexp.Regexp
+	label string
+}
+
+// digestFilters holds the rules that apply to all entries of a digest and the rules of single entries.
+// A tweet has to pass every set of rules that applies to it.
+type digestFilters struct {
+	all []ruleSet
+	// entries are keyed by the lower case digest entry
+	entries map[string][]ruleSet
+}
+
+// compile turns the keywords and regular expressions into a rule set
+func (r filterRules) compile() (ruleSet, error) {
+	var s ruleSet
+	var err error
+	if s.include, err = r.patterns(r.IncludeKeywords, r.IncludeRegex); err != nil {
+		return s, err
+	}
+	if s.exclude, err = r.patterns(r.ExcludeKeywords, r.ExcludeRegex); err != nil {
+		return s, err
+	}
+	if e := strings.TrimSpace(r.Expression); e != "" {
+		if s.expr, err = compileFilter(e); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (r filterRules) patterns(keywords, exprs []string) ([]filterPattern, error) {
+	var patterns []filterPattern
+	for _, k := range keywords {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(k)
+		if r.WholeWords {
+			// \b doesn't work for keywords that start or end with a symbol, like #hashtags
+			expr = `(?:^|[^\p{L}\p{N}_])` + expr + `(?:$|[^\p{L}\p{N}_])`
+		}
+		patterns = append(patterns, filterPattern{regexp.MustCompile(`(?i)` + expr), fmt.Sprintf("keyword %q", k)})
+	}
+	for _, e := range exprs {
+		re, err := regexp.Compile(`(?i)` + e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", e, err)
+		}
+		patterns = append(patterns, filterPattern{re, fmt.Sprintf("regex %q", e)})
+	}
+	return patterns, nil
+}
+
+// empty reports whether the rule set doesn't filter anything
+func (s ruleSet) empty() bool {
+	return len(s.include) == 0 && len(s.exclude) == 0 && s.expr == nil
+}
+
+// allows reports whether a tweet passes the rule set, text is the filterText of the tweet
+func (s ruleSet) allows(f tweetFields, text string) bool {
+	ok, _ := s.explain(f, text, false)
+	return ok
+}
+
+// explain reports whether a tweet passes the rule set and, with verbose set, lists the rules that decided it
+func (s ruleSet) explain(f tweetFields, text string, verbose bool) (bool, []string) {
+	for _, p := range s.exclude {
+		if p.re.MatchString(text) {
+			return false, []string{"excluded by " + p.label}
+		}
+	}
+
+	var reasons []string
+	if len(s.include) > 0 {
+		included := false
+		for _, p := range s.include {
+			if included = p.re.MatchString(text); included {
+				reasons = append(reasons, "included by "+p.label)
+				break
+			}
+		}
+		if !included {
+			return false, []string{"none of the include keywords or regexes matched"}
+		}
+	}
+
+	if s.expr == nil {
+		return true, reasons
+	}
+	ok := s.expr.matches(f)
+	if verbose {
+		reasons = append(reasons, fmt.Sprintf("filter %s: %t", s.expr.source, ok))
+		for _, line := range s.expr.explain(f) {
+			reasons = append(reasons, "  "+line)
+		}
+	}
+	return ok, reasons
+}
+
+// add compiles the rules that apply to all entries
+func (f *digestFilters) add(r filterRules) error {
+	s, err := r.compile()
+	if err != nil || s.empty() {
+		return err
+	}
+	f.all = append(f.all, s)
+	return nil
+}
+
+// addEntry compiles the rules of a single digest entry
+func (f *digestFilters) addEntry(entry string, r filterRules) error {
+	s, err := r.compile()
+	if err != nil {
+		return fmt.Errorf("%s: %w", entry, err)
+	}
+	if s.empty() {
+		return nil
+	}
+	if f.entries == nil {
+		f.entries = make(map[string][]ruleSet)
+	}
+	key := strings.ToLower(entry)
+	f.entries[key] = append(f.entries[key], s)
+	return nil
+}
+
+// empty reports whether the digest doesn't filter anything
+func (f digestFilters) empty() bool {
+	return len(f.all) == 0 && len(f.entries) == 0
+}
+
+// allows reports whether a tweet from the timeline of a digest entry passes the filters
+func (f digestFilters) allows(entry string, t anaconda.Tweet) bool {
+	ok, _ := f.explain(entry, t, false)
+	return ok
+}
+
+// explain reports whether a tweet from the timeline of a digest entry passes the filters and, with verbose set,
+// why. Without verbose only the rule that dropped the tweet is returned.
+func (f digestFilters) explain(entry string, t anaconda.Tweet, verbose bool) (bool, []string) {
+	sets := f.entries[strings.ToLower(entry)]
+	if len(f.all) == 0 && len(sets) == 0 {
+		return true, nil
+	}
+
+	fields := newTweetFields(t, time.Now())
+	text := filterText(t)
+	var reasons []string
+	for _, s := range append(f.all[:len(f.all):len(f.all)], sets...) {
+		ok, r := s.explain(fields, text, verbose)
+		reasons = append(reasons, r...)
+		if !ok {
+			return false, reasons
+		}
+	}
+	return true, reasons
+}
+
+// filterText returns the text the filters are applied to: the text, expanded URLs and hashtags of the tweet and of
+// the retweeted and quoted tweets
+func filterText(t anaconda.Tweet) string {
+	var b strings.Builder
+	for _, tweet := range []*anaconda.Tweet{&t, t.RetweetedStatus, t.QuotedStatus} {
+		if tweet == nil {
+			continue
+		}
+		b.WriteString(html.UnescapeString(tweet.FullText))
+		b.WriteByte('\n')
+		for _, u := range tweet.Entities.Urls {
+			b.WriteString(u.Expanded_url)
+			b.WriteByte('\n')
+		}
+		for _, h := range tweet.Entities.Hashtags {
+			b.WriteString("#" + h.Text)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// runFilterCommand runs the filter sub-commands that don't need any timelines
+func runFilterCommand(args []string) {
+	if len(args) != 1 || args[0] != "fields" {
+		log.Fatal().Msg("usage: filter [fields|test]")
+	}
+
+	for _, f := range exprFields {
+		fmt.Printf("%-17s %-7s %s\n", f.Name, f.Type, f.Doc)
+	}
+}
+
+// runFilterTest fetches the timelines of a digest without applying its filters and shows which tweets match the
+// filters and why
+func (a app) runFilterTest(users []string) {
+	if a.Filters.empty() {
+		fmt.Println("no filters are configured, all tweets match")
+	}
+
+	unfiltered := a
+	unfiltered.Filters = digestFilters{}
+	// every tweet of a thread is checked separately
+	unfiltered.Config.Threads = false
+	ctx, cancel := context.WithTimeout(context.Background(), a.Config.Timeout)
+	defer cancel()
+
+	total, matched := 0, 0
+	for _, result := range unfiltered.fetchTimelines(ctx, users) {
+		if result.Err != nil {
+			fmt.Printf("%s: %v\n\n", result.Source, result.Err)
+		}
+		for _, t := range result.Tweets {
+			ok, reasons := a.Filters.explain(result.ScreenName, t, true)
+			total++
+			label := "no match"
+			if ok {
+				matched++
+				label = "match"
+			}
+
+			created, _ := t.CreatedAtTime()
+			text := strings.Join(strings.Fields(html.UnescapeString(t.FullText)), " ")
+			if runes := []rune(text); len(runes) > 100 {
+				text = string(runes[:100]) + "…"
+			}
+			fmt.Printf("%-8s  %s  %s  %s\n", label, result.Source, created.Local().Format("2006-01-02 15:04"), permalink(t))
+			fmt.Printf("          %s\n", text)
+			for _, r := range reasons {
+				fmt.Printf("          %s\n", r)
+			}
+			fmt.Println()
+		}
+	}
+
+	fmt.Printf("%d of %d tweets match\n", matched, total)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpError is returned by the HTTP based sources when a request was not successful
+type httpError struct {
+	StatusCode int
+	// Reset is the time the rate limit resets, if the response included it
+	Reset time.Time
+	// Message is the error message returned by the API, if any
+	Message string
+	URL     string
+}
+
+func (e *httpError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s returned %d: %s", e.URL, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s returned %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// getJSON performs a GET request and decodes the JSON response into out. Unsuccessful responses are returned
+// as an *httpError.
+func getJSON(ctx context.Context, client *http.Client, rawURL string, header http.Header, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newHTTPError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// newHTTPError builds an *httpError from an unsuccessful response
+func newHTTPError(resp *http.Response) *httpError {
+	u := *resp.Request.URL
+	u.RawQuery = ""
+	e := &httpError{StatusCode: resp.StatusCode, URL: u.String()}
+
+	// Twitter sends the reset time as a unix timestamp, Mastodon as an ISO 8601 date
+	for _, h := range []string{"X-Rate-Limit-Reset", "X-RateLimit-Reset"} {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			e.Reset = time.Unix(sec, 0)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			e.Reset = t
+		}
+		break
+	}
+
+	// most APIs return a JSON object with some form of error message
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var msg struct {
+		Error   interface{} `json:"error"`
+		Message string      `json:"message"`
+		Detail  string      `json:"detail"`
+		Title   string      `json:"title"`
+	}
+	if json.Unmarshal(body, &msg) == nil {
+		switch {
+		case msg.Detail != "":
+			e.Message = msg.Detail
+		case msg.Message != "":
+			e.Message = msg.Message
+		case msg.Title != "":
+			e.Message = msg.Title
+		default:
+			if s, ok := msg.Error.(string); ok {
+				e.Message = s
+			}
+		}
+	} else {
+		e.Message = cleanText(string(body), 200)
+	}
+
+	return e
+}
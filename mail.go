@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+)
+
+// SMTP TLS modes supported by email_server.tls.mode
+const (
+	tlsModeNone     = "none"
+	tlsModeStartTLS = "starttls"
+	tlsModeImplicit = "implicit"
+)
+
+// smtpConfig holds the validated settings used to connect to the email server
+type smtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLSMode  string
+	TLS      *tls.Config
+}
+
+// loadSMTPConfig reads and validates the email_server settings from the config file
+func loadSMTPConfig() (smtpConfig, error) {
+	c := smtpConfig{
+		Host:     viper.GetString("email_server.server"),
+		Port:     viper.GetInt("email_server.port"),
+		Username: viper.GetString("email_server.username"),
+		Password: viper.GetString("email_server.password"),
+		TLSMode:  strings.ToLower(viper.GetString("email_server.tls.mode")),
+	}
+
+	if c.Host == "" {
+		return c, errors.New("email_server.server is required")
+	}
+	if c.Port == 0 {
+		c.Port = 25
+	}
+
+	// TLS is required by default, email_server.tls.mode none has to be set explicitly for plain text servers
+	if c.TLSMode == "" {
+		c.TLSMode = tlsModeStartTLS
+		if c.Port == 465 {
+			c.TLSMode = tlsModeImplicit
+		}
+	}
+
+	switch c.TLSMode {
+	case tlsModeNone:
+		return c, nil
+	case tlsModeStartTLS, tlsModeImplicit:
+	default:
+		return c, fmt.Errorf("invalid email_server.tls.mode %q, expected %s, %s or %s", c.TLSMode, tlsModeNone, tlsModeStartTLS, tlsModeImplicit)
+	}
+
+	verify := true
+	if viper.IsSet("email_server.tls.verify") {
+		verify = viper.GetBool("email_server.tls.verify")
+	}
+
+	c.TLS = &tls.Config{
+		ServerName:         c.Host,
+		InsecureSkipVerify: !verify,
+	}
+	if serverName := viper.GetString("email_server.tls.server_name"); serverName != "" {
+		c.TLS.ServerName = serverName
+	}
+
+	if caFile := viper.GetString("email_server.tls.ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return c, fmt.Errorf("reading email_server.tls.ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return c, fmt.Errorf("email_server.tls.ca_file %s does not contain any PEM encoded certificates", caFile)
+		}
+		c.TLS.RootCAs = pool
+	}
+
+	certFile, keyFile := viper.GetString("email_server.tls.cert_file"), viper.GetString("email_server.tls.key_file")
+	if (certFile == "") != (keyFile == "") {
+		return c, errors.New("email_server.tls.cert_file and email_server.tls.key_file must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return c, fmt.Errorf("loading the email_server.tls client certificate: %w", err)
+		}
+		c.TLS.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// Dial connects and authenticates to the email server using the configured TLS mode.
+// The returned SendCloser can be used to send multiple messages and must be closed when done.
+func (c smtpConfig) Dial() (gomail.SendCloser, error) {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSMode == tlsModeImplicit {
+		conn = tls.Client(conn, c.TLS)
+	}
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if c.TLSMode == tlsModeStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(c.TLS); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if c.Username != "" {
+		if err := client.Auth(c.auth(client)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return &smtpSender{client}, nil
+}
+
+// auth picks an authentication mechanism supported by the server
+func (c smtpConfig) auth(client *smtp.Client) smtp.Auth {
+	_, auths := client.Extension("AUTH")
+
+	switch {
+	case strings.Contains(auths, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(c.Username, c.Password)
+	case strings.Contains(auths, "LOGIN") && !strings.Contains(auths, "PLAIN"):
+		return &loginAuth{username: c.Username, password: c.Password}
+	default:
+		return smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+}
+
+// smtpSender implements gomail.SendCloser on top of an established SMTP connection
+type smtpSender struct {
+	client *smtp.Client
+}
+
+func (s *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := s.client.Mail(from); err != nil {
+		s.client.Reset()
+		return err
+	}
+	for _, addr := range to {
+		if err := s.client.Rcpt(addr); err != nil {
+			// abort the transaction so the connection can be used for the next message
+			s.client.Reset()
+			return err
+		}
+	}
+
+	w, err := s.client.Data()
+	if err != nil {
+		s.client.Reset()
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (s *smtpSender) Close() error {
+	return s.client.Quit()
+}
+
+// loginAuth implements the LOGIN authentication mechanism which isn't provided by net/smtp
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection, refusing to send credentials")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
@@ -2,21 +2,19 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ChimeraCoder/anaconda"
-	"github.com/jakewarren/metascraper"
 	apppaths "github.com/muesli/go-app-paths"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -27,13 +25,63 @@ import (
 
 type app struct {
 	Client *anaconda.TwitterApi
-	Config struct {
-		Threshold       time.Duration
-		ConfigFile      string
-		TweetCount      int
-		Verbose         bool
-		IncludeRetweets bool
-		IncludeReplies  bool
+	State  *stateStore
+	Links  *linkCache
+	SMTP   smtpConfig
+
+	// Filters are the compiled keyword and regex rules of the digest
+	Filters digestFilters
+	// TwitterV2 is set when the Twitter API v2 is used to retrieve timelines
+	TwitterV2 *twitterV2Client
+	// Mastodon retrieves the timelines of Mastodon accounts
+	Mastodon *mastodonClient
+	// Bluesky retrieves the author feeds of Bluesky accounts
+	Bluesky *blueskyClient
+	// Feeds downloads RSS and Atom feeds
+	Feeds *feedClient
+	// Templates are the parsed templates used to render the digest
+	Templates digestTemplates
+	Config    struct {
+		Threshold           time.Duration
+		From                time.Time
+		To                  time.Time
+		OnThisDay           bool
+		Offline             bool
+		Filter              filterRules
+		MinFavorites        int
+		MinRetweets         int
+		TopN                int
+		Highlights          int
+		Threads             bool
+		ConfigFile          string
+		StateFile           string
+		SinceLast           bool
+		TweetCount          int
+		MaxTweets           int
+		Retry               retryPolicy
+		Workers             int
+		RequestInterval     time.Duration
+		Timeout             time.Duration
+		LinkWorkers         int
+		LinkHostConcurrency int
+		CacheFile           string
+		CacheTTL            time.Duration
+		CacheErrorTTL       time.Duration
+		Verbose             bool
+		IncludeRetweets     bool
+		IncludeReplies      bool
+		TemplateFile        string
+		TemplateDir         string
+		TextTemplateFile    string
+		DryRun              bool
+		Output              string
+		OutputFormat        string
+		Listen              string
+		ServeRefresh        time.Duration
+		EmailTo             []string
+		TwitterAPI          string
+		// Profile is the name of the digest profile being run, empty when the accounts were passed as arguments
+		Profile string
 	}
 }
 
@@ -41,12 +89,12 @@ type SeverityHook struct{}
 
 // hasErrorOccurred will be set to 1 if an error has occurred throughout the execution
 // this error is then reported via the exit code so that cronic will fire an email.
-var hasErrorOccured int
+var hasErrorOccured int32
 
 // Run hooks into error events to record that an error has occurred
 func (h SeverityHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
 	if level >= zerolog.ErrorLevel {
-		hasErrorOccured = 1
+		atomic.StoreInt32(&hasErrorOccured, 1)
 		e.Caller()
 	}
 }
@@ -67,19 +115,67 @@ func main() {
 
 	pflag.Usage = func() {
 		fmt.Printf("Description: %s\n\n", "compiles tweets into an email digest")
-		fmt.Printf("Usage: %s -d [duration] [twitter username]\n\n", os.Args[0])
+		fmt.Printf("Usage: %s -d [duration] [twitter username | list:<id> | list:<owner>/<slug> | search:<query> | likes:<username> | home | @user@instance | bluesky:<handle> | feed:<url> | archive:<path>]\n", os.Args[0])
+		fmt.Printf("       %s [--profile name | --all-profiles]\n", os.Args[0])
+		fmt.Printf("       %s cache [stats|prune]\n", os.Args[0])
+		fmt.Printf("       %s templates export-default [directory]\n", os.Args[0])
+		fmt.Printf("       %s serve [twitter username | --profile name]\n", os.Args[0])
+		fmt.Printf("       %s import [--from date --to date | --on-this-day] archive.zip\n", os.Args[0])
+		fmt.Printf("       %s filter fields\n", os.Args[0])
+		fmt.Printf("       %s filter test [--filter expression] [twitter username | --profile name]\n", os.Args[0])
+		fmt.Printf("       %s daemon [--profile name]\n\n", os.Args[0])
 		fmt.Printf("Options:\n")
 		pflag.PrintDefaults()
 		os.Exit(0)
 	}
 
 	showVersion := pflag.BoolP("version", "V", false, "show version information")
-	pflag.IntVar(&a.Config.TweetCount, "tweet-count", 50, "number of tweets to analyze (max 200)")
+	profileName := pflag.String("profile", "", "run the digest with this name from the digests list in the config file")
+	allProfiles := pflag.Bool("all-profiles", false, "run all the digests in the config file")
+	pflag.StringVar(&a.Config.TwitterAPI, "twitter-api", "", "Twitter API used to retrieve timelines (v1.1 or v2), defaults to v2 when only a bearer_token is configured")
+	pflag.IntVar(&a.Config.TweetCount, "tweet-count", 50, "number of tweets to request per page (max 200)")
+	pflag.IntVar(&a.Config.MaxTweets, "max-tweets", 1000, "maximum number of tweets to analyze per user when paginating (0 for no limit)")
+	pflag.IntVar(&a.Config.Retry.MaxAttempts, "retry-attempts", 5, "maximum number of attempts for each Twitter API request")
+	pflag.DurationVar(&a.Config.Retry.BaseDelay, "retry-delay", 5*time.Second, "initial delay between retries, doubled after each attempt")
+	pflag.DurationVar(&a.Config.Retry.MaxDelay, "retry-max-delay", 2*time.Minute, "maximum delay between retries")
+	pflag.IntVar(&a.Config.Workers, "workers", 4, "number of timelines to fetch concurrently")
+	pflag.DurationVar(&a.Config.RequestInterval, "request-interval", time.Second, "minimum interval between Twitter API requests, shared by all workers")
+	pflag.DurationVar(&a.Config.Timeout, "timeout", 15*time.Minute, "maximum time to spend fetching timelines and links before sending the digest with what was retrieved")
+	pflag.IntVar(&a.Config.LinkWorkers, "link-workers", 8, "number of links to unshorten and scrape concurrently")
+	pflag.IntVar(&a.Config.LinkHostConcurrency, "link-host-concurrency", 2, "maximum number of concurrent requests to a single host when enriching links")
+	pflag.StringVar(&a.Config.CacheFile, "cache-file", "", "filepath to the cache of unshortened URLs and link previews")
+	pflag.DurationVar(&a.Config.CacheTTL, "cache-ttl", 7*24*time.Hour, "how long to cache unshortened URLs and link previews (0 disables the cache)")
+	pflag.DurationVar(&a.Config.CacheErrorTTL, "cache-error-ttl", time.Hour, "how long to cache links that could not be retrieved")
 	pflag.StringVarP(&a.Config.ConfigFile, "config", "c", "", "filepath to the config file")
 	pflag.DurationVarP(&a.Config.Threshold, "duration", "d", -24*time.Hour, "how far back to include tweets in the digest (example: \"-24h\")")
 	pflag.StringSliceP("email-to", "t", nil, "email address(es) to send the report to")
+	fromDate := pflag.String("from", "", "only include tweets created after this date (YYYY-MM-DD or RFC 3339), overrides --duration")
+	toDate := pflag.String("to", "", "only include tweets created before the end of this date (YYYY-MM-DD or RFC 3339), without --from the window starts --duration earlier")
+	pflag.BoolVar(&a.Config.OnThisDay, "on-this-day", false, "only include tweets created on today's date in previous years")
+	pflag.BoolVar(&a.Config.Offline, "offline", false, "don't unshorten or preview links, so archives can be rendered without network access")
+	pflag.BoolVar(&a.Config.SinceLast, "since-last", false, "only include tweets newer than the last delivered digest (falls back to --duration for new users)")
+	pflag.StringVar(&a.Config.StateFile, "state-file", "", "filepath to the state file used to track delivered tweets")
 	pflag.BoolVar(&a.Config.IncludeRetweets, "include-retweets", true, "include retweets in the digest")
 	pflag.BoolVar(&a.Config.IncludeReplies, "include-replies", true, "include replies in the digest")
+	pflag.BoolVar(&a.Config.Threads, "threads", true, "show replies of an author to their own tweets as a single thread, fetching the start of the thread if it is older than the digest window")
+	pflag.StringSliceVar(&a.Config.Filter.IncludeKeywords, "include-keywords", nil, "only include tweets that contain one of these keywords")
+	pflag.StringSliceVar(&a.Config.Filter.ExcludeKeywords, "exclude-keywords", nil, "drop tweets that contain one of these keywords")
+	pflag.StringArrayVar(&a.Config.Filter.IncludeRegex, "include-regex", nil, "only include tweets that match one of these regular expressions (repeatable)")
+	pflag.StringArrayVar(&a.Config.Filter.ExcludeRegex, "exclude-regex", nil, "drop tweets that match one of these regular expressions (repeatable)")
+	pflag.BoolVar(&a.Config.Filter.WholeWords, "whole-words", false, "only match keywords that aren't part of a longer word")
+	pflag.IntVar(&a.Config.MinFavorites, "min-favorites", 0, "only include tweets with at least this many likes")
+	pflag.IntVar(&a.Config.MinRetweets, "min-retweets", 0, "only include tweets with at least this many retweets")
+	pflag.IntVar(&a.Config.TopN, "top", 0, "only include this many tweets with the highest engagement score from each timeline (0 includes all tweets)")
+	pflag.IntVar(&a.Config.Highlights, "highlights", 0, "number of the most engaged tweets across all timelines listed in a highlights section at the top of the digest")
+	pflag.StringVar(&a.Config.Filter.Expression, "filter", "", "only include tweets that match this filter expression (example: \"favorites > 100 && !is_retweet\")")
+	pflag.StringVar(&a.Config.TemplateFile, "template", "", "filepath to a template for the HTML version of the digest")
+	pflag.StringVar(&a.Config.TemplateDir, "template-dir", "", "directory with partial templates (*.html and *.txt) available to the digest templates")
+	pflag.StringVar(&a.Config.TextTemplateFile, "text-template", "", "filepath to a template for the plain text version of the digest")
+	pflag.BoolVar(&a.Config.DryRun, "dry-run", false, "render the digest without sending an email (written to stdout unless --output is set)")
+	pflag.StringVarP(&a.Config.Output, "output", "o", "", "filepath to write the rendered digest to")
+	pflag.StringVar(&a.Config.OutputFormat, "output-format", outputHTML, "format of the digest written by --dry-run or --output (html, text or eml)")
+	pflag.StringVar(&a.Config.Listen, "listen", "localhost:8080", "address for the preview server started by the serve command")
+	pflag.DurationVar(&a.Config.ServeRefresh, "serve-refresh", 5*time.Minute, "how long the preview server reuses fetched tweets before fetching them again")
 	pflag.BoolVarP(&a.Config.Verbose, "verbose", "v", false, "enable verbose output")
 	pflag.Parse()
 	_ = viper.BindPFlags(pflag.CommandLine)
@@ -103,14 +199,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	// check for required args
-	if pflag.NArg() < 1 {
-		log.Fatal().Msg("twitter screenname was not provided")
-	}
-	if a.Config.Threshold == 0 {
-		log.Fatal().Msg("threshold duration was not provided")
-	}
-
 	// load up config
 	if a.Config.ConfigFile != "" {
 		viper.SetConfigFile(a.Config.ConfigFile)
@@ -130,506 +218,543 @@ func main() {
 		log.Fatal().Err(err).Msg("Fatal error config file")
 	}
 
+	// load the cache of enriched links
+	if a.Config.CacheFile == "" {
+		a.Config.CacheFile = viper.GetString("cache_file")
+	}
+	if a.Config.CacheFile == "" {
+		cachePath, cacheDirErr := defaultCachePath()
+		if cacheDirErr != nil {
+			log.Fatal().Err(cacheDirErr).Msg("unable to determine the cache file location")
+		}
+		a.Config.CacheFile = cachePath
+	}
+	if a.Config.CacheTTL > 0 {
+		var cacheErr error
+		if a.Links, cacheErr = loadLinkCache(a.Config.CacheFile, a.Config.CacheTTL, a.Config.CacheErrorTTL); cacheErr != nil {
+			log.Fatal().Err(cacheErr).Str("path", a.Config.CacheFile).Msg("error loading link cache")
+		}
+	}
+
+	// run sub-commands
+	switch pflag.Arg(0) {
+	case "cache":
+		a.runCacheCommand(pflag.Args()[1:])
+		os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+	case "templates":
+		runTemplatesCommand(pflag.Args()[1:])
+		os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+	case "filter":
+		// filter test needs the timelines, so it runs once the sources are set up
+		if pflag.Arg(1) != "test" {
+			runFilterCommand(pflag.Args()[1:])
+			os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+		}
+	}
+
+	users := pflag.Args()
+	serving, daemon, importing := pflag.Arg(0) == "serve", pflag.Arg(0) == "daemon", pflag.Arg(0) == "import"
+	testing := pflag.Arg(0) == "filter"
+	if serving || daemon || importing {
+		users = users[1:]
+	}
+	if testing {
+		users = users[2:]
+	}
+	// import builds the digest from archives without accessing the network
+	if importing {
+		if len(users) == 0 {
+			log.Fatal().Msg("usage: import [--from date --to date | --on-this-day] archive.zip")
+		}
+		for i, path := range users {
+			if !strings.HasPrefix(path, sourceArchive+":") {
+				users[i] = sourceArchive + ":" + path
+			}
+		}
+		a.Config.Offline = true
+	}
+	// the daemon runs all scheduled digests unless a single one is selected
+	if daemon && *profileName == "" {
+		*allProfiles = true
+	}
+
+	// check for required args
+	if a.Config.Threshold == 0 {
+		log.Fatal().Msg("threshold duration was not provided")
+	}
+	var dateErr error
+	if a.Config.From, dateErr = parseDate(*fromDate, false); dateErr != nil {
+		log.Fatal().Err(dateErr).Msg("invalid --from")
+	}
+	if a.Config.To, dateErr = parseDate(*toDate, true); dateErr != nil {
+		log.Fatal().Err(dateErr).Msg("invalid --to")
+	}
+	if a.Config.Retry.MaxAttempts < 1 {
+		log.Fatal().Msg("retry attempts must be at least 1")
+	}
+	if a.Config.MinFavorites < 0 || a.Config.MinRetweets < 0 || a.Config.TopN < 0 || a.Config.Highlights < 0 {
+		log.Fatal().Msg("--min-favorites, --min-retweets, --top and --highlights can't be negative")
+	}
+	switch a.Config.OutputFormat {
+	case outputHTML, outputText, outputEML:
+	default:
+		log.Fatal().Str("format", a.Config.OutputFormat).Msg("invalid output format, expected html, text or eml")
+	}
+
+	profiles, profileErr := selectProfiles(*profileName, *allProfiles, users)
+	if profileErr != nil {
+		log.Fatal().Err(profileErr).Msg("unable to select the digests to run")
+	}
+	if serving && len(profiles) != 1 {
+		log.Fatal().Msg("the serve command previews a single digest, use --profile to select one")
+	}
+	if testing && len(profiles) != 1 {
+		log.Fatal().Msg("the filter test command checks a single digest, use --profile to select one")
+	}
+
+	// the email server isn't needed when only previewing the digest
+	if !a.Config.DryRun && !serving && !testing {
+		var smtpErr error
+		if a.SMTP, smtpErr = loadSMTPConfig(); smtpErr != nil {
+			log.Fatal().Err(smtpErr).Msg("invalid email server configuration")
+		}
+	}
+
 	// init Twitter API
-	anaconda.SetConsumerKey(viper.GetString("consumer_key"))
-	anaconda.SetConsumerSecret(viper.GetString("consumer_secret"))
-	a.Client = anaconda.NewTwitterApi(viper.GetString("access_token"), viper.GetString("access_token_secret"))
+	if a.Config.TwitterAPI == "" {
+		a.Config.TwitterAPI = viper.GetString("twitter_api")
+	}
+	if a.Config.TwitterAPI == "" {
+		a.Config.TwitterAPI = twitterAPIv1
+		if viper.GetString("consumer_key") == "" && viper.GetString("bearer_token") != "" {
+			a.Config.TwitterAPI = twitterAPIv2
+		}
+	}
+	switch a.Config.TwitterAPI {
+	case twitterAPIv1:
+	case twitterAPIv2:
+		if viper.GetString("bearer_token") == "" {
+			log.Fatal().Msg("bearer_token is required to use the Twitter API v2")
+		}
+		a.TwitterV2 = newTwitterV2Client(viper.GetString("bearer_token"))
+	default:
+		log.Fatal().Str("api", a.Config.TwitterAPI).Msg("invalid Twitter API, expected v1.1 or v2")
+	}
+	// the v1.1 client is also used to embed linked tweets when the credentials are available
+	if a.Config.TwitterAPI == twitterAPIv1 || viper.GetString("consumer_key") != "" {
+		anaconda.SetConsumerKey(viper.GetString("consumer_key"))
+		anaconda.SetConsumerSecret(viper.GetString("consumer_secret"))
+		a.Client = anaconda.NewTwitterApi(viper.GetString("access_token"), viper.GetString("access_token_secret"))
+		a.Client.HttpClient = &http.Client{Timeout: 30 * time.Second}
+		// anaconda would otherwise sleep through rate limits on its own, ignoring the retry policy and --timeout
+		a.Client.ReturnRateLimitError(true)
+	}
+	a.Mastodon = newMastodonClient()
+	a.Bluesky = newBlueskyClient()
+	a.Feeds = newFeedClient()
+	a.Config.Retry.Limiter = newRateLimiter(a.Config.RequestInterval)
+
+	// load the state of previously delivered digests
+	if a.Config.StateFile == "" {
+		a.Config.StateFile = viper.GetString("state_file")
+	}
+	if a.Config.StateFile == "" {
+		statePath, stateDirErr := defaultStatePath()
+		if stateDirErr != nil {
+			log.Fatal().Err(stateDirErr).Msg("unable to determine the state file location")
+		}
+		a.Config.StateFile = statePath
+	}
+	var stateErr error
+	if a.State, stateErr = loadState(a.Config.StateFile); stateErr != nil {
+		log.Fatal().Err(stateErr).Str("path", a.Config.StateFile).Msg("error loading state file")
+	}
+
+	if daemon {
+		a.runDaemon(*profileName)
+		return
+	}
 
-	tweets := make([]anaconda.Tweet, 0)
-	for _, u := range pflag.Args() {
-		t := a.getTweetsForUser(u)
-		tweets = append(tweets, t...)
+	// apply the settings of each profile and load its templates
+	runners, profileErr := a.prepareProfiles(profiles)
+	if profileErr != nil {
+		log.Fatal().Err(profileErr).Msg("error loading templates")
 	}
 
-	if len(tweets) == 0 {
+	if serving {
+		runners[0].serve(profiles[0].Accounts)
 		return
 	}
+	if testing {
+		runners[0].runFilterTest(profiles[0].Accounts)
+		os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+	}
+
+	var digests []renderedDigest
+	for i, p := range profiles {
+		if d := runners[i].renderDigest(p, len(profiles) > 1); d != nil {
+			digests = append(digests, *d)
+		}
+	}
+	if a.Config.DryRun || len(digests) == 0 {
+		os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+	}
+
+	if mailErr := a.deliver(digests); mailErr != nil {
+		log.Fatal().Err(mailErr).Str("server", a.SMTP.Host).Msg("error connecting to the email server")
+	}
+
+	os.Exit(int(atomic.LoadInt32(&hasErrorOccured)))
+}
+
+// prepareProfiles applies the settings of each profile and loads its templates.
+// The template settings and recipients fall back to the config file when they weren't set on the command line.
+func (a app) prepareProfiles(profiles []profile) ([]app, error) {
+	if a.Config.TemplateFile == "" {
+		a.Config.TemplateFile = viper.GetString("template_file")
+	}
+	if a.Config.TemplateDir == "" {
+		a.Config.TemplateDir = viper.GetString("template_dir")
+	}
+	if a.Config.TextTemplateFile == "" {
+		a.Config.TextTemplateFile = viper.GetString("text_template_file")
+	}
+	a.Config.EmailTo = viper.GetStringSlice("email-to")
+
+	runners := make([]app, len(profiles))
+	for i, p := range profiles {
+		var err error
+		if runners[i], err = a.withProfile(p); err != nil {
+			if p.Name != "" {
+				return nil, fmt.Errorf("digest %s: %w", p.Name, err)
+			}
+			return nil, err
+		}
+	}
+
+	return runners, nil
+}
+
+// renderDigest builds the digest of a profile and renders the email. With --dry-run or --output the rendered
+// digest is also written out. It returns nil if there is nothing to send.
+func (a app) renderDigest(p profile, multiple bool) *renderedDigest {
+	body := a.buildDigest(p.Accounts)
+	if len(body.Tweets) == 0 && len(body.Failed) == 0 {
+		return nil
+	}
+
+	subject, err := p.subject(time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("profile", p.Name).Msg("error rendering the subject")
+		return nil
+	}
 
 	m := gomail.NewMessage()
 	m.SetAddressHeader("From", viper.GetString("email_from.address"), viper.GetString("email_from.name"))
-	m.SetHeader("To", viper.GetStringSlice("email-to")...)
-	m.SetHeader("Subject", fmt.Sprintf("@%s Tweet Digest for %s", strings.Join(pflag.Args(), "/@"), time.Now().Format("1/2/06")))
-	m.SetBody("text/html", a.generateHTML(tweets))
-	d := gomail.Dialer{
-		Host:     viper.GetString("email_server.server"),
-		Port:     viper.GetInt("email_server.port"),
-		Username: viper.GetString("email_server.username"),
-		Password: viper.GetString("email_server.password"),
+	m.SetHeader("To", a.Config.EmailTo...)
+	m.SetHeader("Subject", subject)
+	html, text := a.generateHTML(body), a.generateText(body)
+	// the preferred alternative has to be added last, so the plain text version goes first
+	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html)
+
+	if a.Config.DryRun || a.Config.Output != "" {
+		path := p.outputPath(a.Config.Output, multiple)
+		if err := writeDigest(path, a.Config.OutputFormat, m, html, text); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("error writing digest")
+		}
+	}
+
+	return &renderedDigest{app: a, profile: p, message: m}
+}
+
+// deliver sends the digests over a single connection to the email server and records the delivered tweets.
+// An error is only returned if the connection to the email server failed, failed sends are logged.
+func (a app) deliver(digests []renderedDigest) error {
+	sender, err := a.SMTP.Dial()
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+
+	for _, d := range digests {
+		if err := gomail.Send(sender, d.message); err != nil {
+			log.Error().Err(err).Str("profile", d.profile.Name).Msg("error sending email")
+			continue
+		}
+
+		// only record the delivered tweets once the email has been sent so a failed send is retried on the next run
+		if err := a.State.Commit(d.app.stateKeys(d.profile.Accounts)); err != nil {
+			log.Error().Err(err).Str("path", a.Config.StateFile).Msg("error saving state file")
+		}
+	}
+
+	return nil
+}
+
+// buildDigest fetches the timelines of the users and enriches the links found in their tweets, unless --offline
+// is set
+func (a app) buildDigest(users []string) emailBody {
+	ctx, cancel := context.WithTimeout(context.Background(), a.Config.Timeout)
+	defer cancel()
+
+	body := newEmailBody(a.fetchTimelines(ctx, users))
+	body.Highlights = highlights(body.Tweets, a.Config.Highlights)
+	if len(body.Tweets) == 0 || a.Config.Offline {
+		return body
+	}
+
+	// the links of the replies in threads are previewed as well
+	tweets := append([]anaconda.Tweet(nil), body.Tweets...)
+	for _, t := range body.Threads {
+		tweets = append(tweets, t.Replies()...)
 	}
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	if mailErr := d.DialAndSend(m); mailErr != nil {
-		panic(mailErr)
+	body.Links = a.enrichLinks(ctx, tweets)
+	if cacheErr := a.Links.Save(); cacheErr != nil {
+		log.Error().Err(cacheErr).Str("path", a.Config.CacheFile).Msg("error saving link cache")
 	}
 
-	os.Exit(hasErrorOccured)
+	return body
 }
 
-func (a app) getTweetsForUser(s string) []anaconda.Tweet {
-	v := url.Values{}
-	v.Set("screen_name", s)
-	v.Set("count", strconv.Itoa(a.Config.TweetCount))
+// timelineResult holds the tweets selected for the digest from a single timeline
+type timelineResult struct {
+	// ScreenName is the digest entry the timeline was requested for, see parseSource
+	ScreenName string
+	// Source is the label of the timeline shown in the digest (@user, list owner/slug or "query")
+	Source string
+	Tweets []anaconda.Tweet
+	// Threads are the threads started by Tweets, keyed by the ID of their first tweet
+	Threads map[string]digestThread
+	// Truncated is set when the pagination ceiling was hit before reaching the start of the digest window, or the
+	// last delivered tweet when SinceLast is set
+	Truncated bool
+	// SinceLast is set when only the tweets newer than the last delivered tweet were requested
+	SinceLast bool
+	// Err is set when the timeline could not be (completely) retrieved
+	Err error
+}
 
-	var timeline []anaconda.Tweet
+// getTweets retrieves the tweets in the digest window from the timeline of a digest entry
+func (a app) getTweets(ctx context.Context, s string) timelineResult {
+	result := timelineResult{ScreenName: s, Source: s, Tweets: make([]anaconda.Tweet, 0)}
 
-	// for some reason Twitter will occasionally only return one tweet, so use this hacky retry method
-	for i := 1; i <= 5; i++ {
-		var err error
-		timeline, err = a.Client.GetUserTimeline(v)
+	source, err := parseSource(s)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid digest entry")
+		result.Err = err
+		return result
+	}
+	result.Source = source.String()
+	src, err := a.newSource(source)
+	if err != nil {
+		log.Error().Err(err).Str("source", result.Source).Msg("unsupported digest entry")
+		result.Err = err
+		return result
+	}
+
+	// in since-last mode, ask only for tweets newer than the last delivered one. Likes are paged by the ID of the
+	// liked tweet, so an old tweet that was liked recently would never be newer; they use the window instead.
+	sinceID := a.State.LastTweetID(a.stateKey(s))
+	useSinceID := a.Config.SinceLast && sinceID > 0 && !a.historical() && source.chronological()
+	if !useSinceID {
+		sinceID = 0
+	}
+	result.SinceLast = useSinceID
+
+	window := a.window()
+
+	// walk backwards through the timeline until the window (or the ceiling) is reached
+	var timeline []anaconda.Tweet
+	cursor := ""
+	for {
+		tweets, next, err := src.Page(ctx, sinceID, cursor)
 		if err != nil {
-			log.Error().Err(err).Msg("error getting timeline")
+			log.Error().Err(err).Str("source", result.Source).Msg("error getting timeline")
+			result.Err = errors.New(describeError(err))
+			break
+		}
+		if len(tweets) == 0 {
+			break
+		}
+		timeline = append(timeline, tweets...)
+
+		oldest := tweets[len(tweets)-1]
+		oldestTime, _ := oldest.CreatedAtTime()
+		if !source.chronological() {
+			// an old tweet can be liked recently, so only stop once a whole page is outside the window
+			for _, t := range tweets {
+				if created, _ := t.CreatedAtTime(); created.After(oldestTime) {
+					oldestTime = created
+				}
+			}
+		}
+		if !useSinceID && window.passed(oldestTime) {
+			break
 		}
 
-		tweetCount := len(timeline)
-		log.Debug().Int("tweet-count", tweetCount).Int("attempt", i).Msg("pulled down tweets")
-		if tweetCount > 1 || a.Config.TweetCount == 1 {
+		if a.Config.MaxTweets > 0 && len(timeline) >= a.Config.MaxTweets {
+			result.Truncated = true
+			msg := "reached the maximum number of tweets before the start of the digest window, results were truncated"
+			if useSinceID {
+				msg = "reached the maximum number of tweets before the last delivered tweet, older tweets since the last digest were skipped"
+			}
+			log.Warn().Str("source", result.Source).Int("max-tweets", a.Config.MaxTweets).Msg(msg)
 			break
 		}
 
-		backoffInterval := 5
-		log.Debug().Msgf("retrying after %d seconds...", i*backoffInterval)
-		time.Sleep(time.Duration(i*backoffInterval) * time.Second)
+		if next == "" {
+			break
+		}
+		cursor = next
 	}
 
-	dateThreshold := time.Now().Local().Add(a.Config.Threshold)
-
-	tweets := make([]anaconda.Tweet, 0)
-
+	// don't advance the state past a partially retrieved timeline, otherwise the missing tweets would be skipped.
+	// A truncated timeline in since-last mode does advance, so the next digest doesn't request the same tweets
+	// again; the gap before the oldest retrieved tweet is reported in the digest instead.
+	advance := result.Err == nil
+	var retrieved []anaconda.Tweet
 	for _, tweet := range timeline {
 		cTime, _ := tweet.CreatedAtTime()
-		cTime = cTime.Local() // convert to local timezone
 
-		if cTime.After(dateThreshold) {
+		if useSinceID || window.contains(cTime) {
+			if advance {
+				a.State.MarkSeen(a.stateKey(s), tweet.Id)
+			}
+			retrieved = append(retrieved, tweet)
 
 			if !a.Config.IncludeRetweets && tweet.RetweetedStatus != nil {
 				continue
 			}
 
-			if !a.Config.IncludeReplies && tweet.InReplyToStatusIdStr != "" && (tweet.InReplyToUserID != tweet.User.Id) {
+			if !a.Config.IncludeReplies && isReply(tweet) && (tweet.InReplyToUserID != tweet.User.Id) {
+				continue
+			}
+
+			if !a.Filters.allows(s, tweet) || !a.engaging(tweet) {
 				continue
 			}
 
-			tweets = append([]anaconda.Tweet{tweet}, tweets...)
+			result.Tweets = append([]anaconda.Tweet{tweet}, result.Tweets...)
 		}
 	}
+	// threads are only put back together in chronological timelines. They count as a single tweet for --top.
+	if a.Config.Threads && source.chronological() {
+		result.Tweets, result.Threads = a.groupThreads(ctx, src, result.Source, result.Tweets, retrieved)
+	}
+	result.Tweets = topTweets(result.Tweets, result.Threads, a.Config.TopN)
 
-	return tweets
+	return result
 }
 
+// emailBody is the data passed to the digest templates
 type emailBody struct {
+	// Tweets are the tweets in the digest, oldest first
 	Tweets []anaconda.Tweet
+	// Highlights are the tweets with the most likes and retweets, see --highlights
+	Highlights []anaconda.Tweet
+	// Threads are the threads started by tweets in the digest keyed by the ID of their first tweet, see --threads
+	Threads map[string]digestThread
+	// Truncated lists the timelines that hit the --max-tweets ceiling
+	Truncated []timelineResult
+	// Failed lists the timelines that could not be retrieved, see timelineResult.Err
+	Failed []timelineResult
+	// Links holds the enriched links keyed by the URL found in the tweets
+	Links map[string]*linkPreview
 }
 
-func (a app) generateHTML(tweets []anaconda.Tweet) string {
-	var (
-		e   emailBody
-		err error
-	)
-	e.Tweets = tweets
+// newEmailBody collects the tweets and notices from the fetched timelines
+func newEmailBody(results []timelineResult) emailBody {
+	var e emailBody
+	for _, r := range results {
+		e.Tweets = append(e.Tweets, r.Tweets...)
+		for id, t := range r.Threads {
+			if e.Threads == nil {
+				e.Threads = make(map[string]digestThread)
+			}
+			e.Threads[id] = t
+		}
+		if r.Truncated {
+			e.Truncated = append(e.Truncated, r)
+		}
+		if r.Err != nil {
+			e.Failed = append(e.Failed, r)
+		}
+	}
 
-	funcMap := template.FuncMap{
-		"formatTime": func(t anaconda.Tweet) template.HTML {
+	return e
+}
+
+// finalURL returns the unshortened version of a URL, or the URL itself if it could not be resolved
+func (e emailBody) finalURL(url string) string {
+	if p, ok := e.Links[url]; ok && p.FinalURL != "" {
+		return p.FinalURL
+	}
+	return url
+}
+
+// funcMap returns the functions available to the digest templates
+func (a app) funcMap(e emailBody) template.FuncMap {
+	return template.FuncMap{
+		"formatTime": func(t anaconda.Tweet) string {
 			// get the creation time and convert to user's local timezone
 			cTime, _ := t.CreatedAtTime()
 			cTime = cTime.Local()
-			return template.HTML(cTime.Format("Jan 2"))
+			return cTime.Format("Jan 2")
 		},
-		// enrich URLs by using the twitter images from URLs if they provide the supported metadata
+		// render the preview images for a link collected by enrichLinks
 		"getTwitterImage": func(url string) template.HTML {
-			var output string
-
-			log.Debug().Str("url", url).Msg("fetching image for URL")
-
-			if strings.HasPrefix(url, "https://twitter.com/") && strings.Contains(url, "/status/") {
-				tweetCardText, tweetURL := a.generateTwitterCard(url)
-				output += tweetCardText
-				if tweetURL != "" {
-					url = tweetURL
-				}
-			}
-
-			p, metaErr := metascraper.Scrape(url)
-			if metaErr != nil {
-				log.Error().Str("url", url).Err(metaErr).Msg("error getting metadata for an url")
+			p, ok := e.Links[url]
+			if !ok {
 				return ""
 			}
 
-			for _, m := range p.MetaData() {
-				if m.Name == "twitter:image" || m.Name == "og:image" || m.Name == "twitter:image:src" {
-					output += fmt.Sprintf(`<img src="%s" style="max-width:100%%; padding-bottom:5px">`, m.Content)
+			output := sanitizeHTML(p.Card)
+			for _, img := range p.Images {
+				if img = safeURL(img); img != "" {
+					output += template.HTML(`<img src="` + template.HTMLEscapeString(img) + `" style="max-width:100%; padding-bottom:5px">`)
 				}
 			}
 
-			return template.HTML(output)
+			return output
 		},
 		// unshorten a single URL
-		"unshortenURL": func(url string) template.HTML {
-			finalURL, _ := unshortenURL(url)
-			return template.HTML(finalURL)
+		"unshortenURL": e.finalURL,
+		// escape the text of a tweet and turn its entities into links
+		"renderText": e.renderText,
+		// the text of a tweet with expanded links, for the plain text email
+		"plainText": e.plainText,
+		// the start of the text of a tweet on a single line, for the highlights
+		"excerpt": func(t anaconda.Tweet) string {
+			text := collapseSpace(e.plainText(t))
+			if runes := []rune(text); len(runes) > 140 {
+				text = string(runes[:140]) + "…"
+			}
+			return text
 		},
-		// use regex to attempt to unshorten all URLs in a block of text
-		"unshortenURLsinText": func(text string) template.HTML {
-			output := text
-
-			for _, match := range urlRE.FindAllString(text, -1) {
-				finalURL, unshortenErr := unshortenURL(match)
-				if unshortenErr == nil {
-					output = strings.ReplaceAll(output, match, finalURL)
-				}
+		// the thread started by a tweet, nil for tweets that don't start a thread
+		"thread": func(t anaconda.Tweet) *digestThread {
+			if thread, ok := e.Threads[t.IdStr]; ok {
+				return &thread
 			}
-
-			return template.HTML(output)
+			return nil
+		},
+		// the URL of a tweet and of the profile of an account
+		"permalink":  permalink,
+		"profileURL": profileURL,
+		// the source of an image, images from an archive are embedded as data URIs
+		"mediaSrc": func(m anaconda.EntityMedia) interface{} {
+			if isDataURI(m.Media_url_https) {
+				return template.URL(m.Media_url_https)
+			}
+			return m.Media_url_https
+		},
+		// the URL of an image for the plain text email, which can't embed images
+		"mediaLink": func(m anaconda.EntityMedia) string {
+			if isDataURI(m.Media_url_https) {
+				return m.Media_url
+			}
+			return m.Media_url_https
 		},
 	}
-
-	t := template.New("emailTmpl").Funcs(funcMap)
-	if t, err = t.Parse(emailTemplate); err != nil {
-		panic(err)
-	}
-	var buf bytes.Buffer
-	if err = t.Execute(&buf, e); err != nil {
-		log.Error().Err(err).Msg("error executing template")
-	}
-
-	return buf.String()
-}
-
-// TODO: make this prettier
-func (a app) generateTwitterCard(tweetURL string) (string, string) {
-	var output string
-
-	log.Debug().Str("url", tweetURL).Msg("generating twitter card")
-
-	v := url.Values{}
-	v.Set("url", tweetURL)
-	v.Set("dnt", "true")
-
-	o, err := a.Client.GetOEmbed(v)
-	if err == nil {
-		output = o.Html
-	} else {
-		log.Error().Err(err).Str("url", tweetURL).Msg("error generating tweet card")
-	}
-
-	return output, tweetURL
-}
-
-func unshortenURL(url string) (string, error) {
-	var output string
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
-	}
-	client := http.Client{
-		Transport: tr,
-		Timeout:   30 * time.Second,
-	}
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible;)")
-
-	resp, unshortenErr := client.Do(req)
-	if unshortenErr == nil {
-		output = resp.Request.URL.String()
-		resp.Body.Close()
-	}
-	return output, unshortenErr
 }
-
-const emailTemplate = `
-<html xmlns="http://www.w3.org/1999/xhtml"
-    style='box-sizing:border-box; font-family:"Helvetica Neue", Helvetica, Arial, sans-serif'>
-
-<head>
-    <meta http-equiv="Content-Type" content="text/html; charset=utf-8=">
-    <meta name="viewport" content="width=device-width">
-    <title></title>
-
-
-</head>
-
-<body style="height:100%; margin:0; width:100%; background-color:#fff" height="100%" width="100%" bgcolor="#ffffff">
-
-    <style type="text/css">
-        @media only screen and (max-width: 640px) {
-            body {
-                padding: 0 !important
-            }
-
-            h1,
-            h2,
-            h3,
-            h4 {
-                font-weight: 800 !important;
-                margin: 20px 0 5px !important
-            }
-
-            h1 {
-                font-size: 22px !important
-            }
-
-            h2 {
-                font-size: 18px !important
-            }
-
-            h3 {
-                font-size: 16px !important
-            }
-
-            .container {
-                padding: 0 !important;
-                width: 100% !important
-            }
-
-            .content {
-                padding: 0 !important
-            }
-
-            .content-wrap {
-                padding: 10px !important
-            }
-
-            .invoice {
-                width: 100% !important
-            }
-        }
-    </style>
-    <base target="_target">
-    <table style="table-layout:fixed; width:100%; max-width:600px; clear:both !important; margin:0 auto !important"
-        width="100%">
-
-		{{range .Tweets}}
-        
-
-{{ if .RetweetedStatus }}
-
-<tr>
-            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none" valign="top">
-<img style="max-width:100%; display:inline; height:10px; padding-top:1px; vertical-align:baseline; width:auto" src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png" height="10" valign="baseline" width="auto"> {{.User.ScreenName}} Retweeted <br>
-                <table style="table-layout:fixed; width:100%" width="100%">
-                    <tr>
-						
-                        <td style="vertical-align:top; text-align:center; width:60px" valign="top" align="center"
-                            width="60">
-
-
-                            <img style="max-width:100%; border-radius:50%; height:48px; min-width:48px; width:48px"
-                                src="{{.RetweetedStatus.User.ProfileImageUrlHttps}}"
-                                height="48" width="48">
-                        </td>
-                        <td style="vertical-align:top" valign="top">
-                            <table cellpadding="0" cellspacing="0" border="0"
-                                style="table-layout:fixed; width:100%; padding-left:5px" width="100%">
-                                <tr>
-                                    <td style="vertical-align:top" valign="top">
-
-                                        <a href="https://twitter.com/{{.RetweetedStatus.User.ScreenName}}/status/{{.RetweetedStatus.Id}}"
-                                            style="color:black; text-decoration:None">
-                                            <strong>{{ .RetweetedStatus.User.Name }}</strong>
-                                            <span>@{{.RetweetedStatus.User.ScreenName}}</span>
-                                            <span style="float:right;">{{.RetweetedStatus | formatTime }}</span>
-                                        </a>
-                                    </td>
-                                </tr>
-                                <tr>
-                                    <td style="vertical-align:top" valign="top">
-
-                                        <p style="margin-bottom:10px; margin:0; padding-bottom:5px; white-space:pre-wrap">
-{{ .RetweetedStatus.FullText | unshortenURLsinText}}    
-										</p>
-
-{{range .RetweetedStatus.ExtendedEntities.Media}}
-<img src="{{.Media_url_https}}"  style="max-width:100%; padding-bottom:5px">
-{{end}}
-
-{{range .RetweetedStatus.Entities.Urls}}
-
-<table style="table-layout:fixed; width:100%; border-radius:12px; border:1px solid #E2E6E6; padding:5px; margin:5px 0"   width="100%">
-    <tr>
-
-        <td style="vertical-align:top" valign="top">
-            <table cellpadding="0" cellspacing="0" border="0"
-                style="table-layout:fixed; width:100%; padding-left:5px"
-                width="100%">
-                <tr>
-                    <td style="vertical-align:top" valign="top">
-                        <p
-                            style="margin-bottom:10px; margin:0; overflow:hidden; text-overflow:inherit; white-space:normal">
-                            <a href="{{.Expanded_url | unshortenURL}}"
-                                target="_blank"
-                                style="color:#000; text-decoration:None">
-                                {{.Expanded_url | getTwitterImage}}
-
-                                <strong>{{.Expanded_url | unshortenURL}}</strong>
-                            </a>
-                        </p>
-                    </td>
-                </tr>
-
-                
-
-            </table>
-
-        </td>
-    </tr>
-</table>
-
-{{end}}
-
-                                    </td>
-                                </tr>
-
-
-                                <td style="vertical-align:top" valign="top">
-                                    <table style="table-layout:fixed; width:100%" width="100%">
-                                        <tr>
-                                            <a href="https://twitter.com/{{.User.ScreenName}}/status/{{.Id}}"
-                                                target="_blank" style="color:#348eda; text-decoration:None">
-                                                <p style="margin-bottom:10px; margin:0">
-
-                                                    <span style="color:#4e555b; margin-right:28px">
-                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png"
-                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
-                                                            height="16" valign="text-top" width="auto">
-                                                        <span>{{.RetweetedStatus.RetweetCount}}</span>
-                                                    </span>
-                                                    <span style="color:#4e555b; margin-right:28px">
-                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/c/c9/Twitter_favorite.png"
-                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
-                                                            height="16" valign="text-top" width="auto">
-                                                        <span>{{.RetweetedStatus.FavoriteCount}}</span>
-                                                    </span>
-                                                </p>
-                                            </a>
-                                        </tr>
-                                    </table>
-                                </td>
-                            </table>
-                            <a href="https://twitter.com/{{.RetweetedStatus.User.ScreenName}}/"
-                                target="_blank" style="color:#348eda; text-decoration:None"></a>
-                        </td>
-                    </tr>
-                </table>
-            </td>
-        </tr>
-{{ else }}
-<tr>
-            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none" valign="top">
-
-                <table style="table-layout:fixed; width:100%" width="100%">
-                    <tr>
-
-                        <td style="vertical-align:top; text-align:center; width:60px" valign="top" align="center"
-                            width="60">
-                            <img style="max-width:100%; border-radius:50%; height:48px; min-width:48px; width:48px"
-                                src="{{.User.ProfileImageUrlHttps}}"
-                                height="48" width="48">
-                        </td>
-                        <td style="vertical-align:top" valign="top">
-                            <table cellpadding="0" cellspacing="0" border="0"
-                                style="table-layout:fixed; width:100%; padding-left:5px" width="100%">
-                                <tr>
-                                    <td style="vertical-align:top" valign="top">
-
-                                        <a href="https://twitter.com/{{.User.ScreenName}}/status/{{.Id}}"
-                                            style="color:black; text-decoration:None">
-                                            <strong>{{ .User.Name }}</strong>
-                                            <span>@{{.User.ScreenName}}</span>
-                                            <span style="float:right;">{{. | formatTime }}</span>
-                                        </a>
-                                    </td>
-                                </tr>
-                                <tr>
-                                    <td style="vertical-align:top" valign="top">
-
-                                        <p style="margin-bottom:10px; margin:0; padding-bottom:5px; white-space:pre-wrap">
-{{ .FullText | unshortenURLsinText}}    
-										</p>
-
-{{range .ExtendedEntities.Media}}
-<img src="{{.Media_url_https}}"  style="max-width:100%; padding-bottom:5px">
-{{end}}
-
-{{range .Entities.Urls}}
-
-<table style="table-layout:fixed; width:100%; border-radius:12px; border:1px solid #E2E6E6; padding:5px; margin:5px 0"   width="100%">
-    <tr>
-
-        <td style="vertical-align:top" valign="top">
-            <table cellpadding="0" cellspacing="0" border="0"
-                style="table-layout:fixed; width:100%; padding-left:5px"
-                width="100%">
-                <tr>
-                    <td style="vertical-align:top" valign="top">
-                        <p
-                            style="margin-bottom:10px; margin:0; overflow:hidden; text-overflow:inherit; white-space:normal">
-                            <a href="{{.Expanded_url | unshortenURL}}"
-                                target="_blank"
-                                style="color:#000; text-decoration:None">
-                                {{.Expanded_url | getTwitterImage}}
-
-                                <strong>{{.Expanded_url | unshortenURL}}</strong>
-                            </a>
-                        </p>
-                    </td>
-                </tr>
-
-                
-
-            </table>
-        </td>
-    </tr>
-</table>
-{{end}}
-
-                                    </td>
-                                </tr>
-
-
-                                <td style="vertical-align:top" valign="top">
-                                    <table style="table-layout:fixed; width:100%" width="100%">
-                                        <tr>
-                                            <a href="https://twitter.com/{{.User.ScreenName}}/status/{{.Id}}"
-                                                target="_blank" style="color:#348eda; text-decoration:None">
-                                                <p style="margin-bottom:10px; margin:0">
-
-                                                    <span style="color:#4e555b; margin-right:28px">
-                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png"
-                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
-                                                            height="16" valign="text-top" width="auto">
-                                                        <span>{{.RetweetCount}}</span>
-                                                    </span>
-                                                    <span style="color:#4e555b; margin-right:28px">
-                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/c/c9/Twitter_favorite.png"
-                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
-                                                            height="16" valign="text-top" width="auto">
-                                                        <span>{{.FavoriteCount}}</span>
-                                                    </span>
-                                                </p>
-                                            </a>
-                                        </tr>
-                                    </table>
-                                </td>
-                            </table>
-                            <a href="https://twitter.com/{{.User.ScreenName}}/"
-                                target="_blank" style="color:#348eda; text-decoration:None"></a>
-                        </td>
-                    </tr>
-                </table>
-            </td>
-        </tr>
-
-{{ end }}
-		{{end}}
-
-        
-    </table>
-
-
-
-
-
-
-</body>
-
-</html>
-`
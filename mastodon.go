@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// maximum number of statuses returned by a single Mastodon request
+const maxMastodonCount = 40
+
+// mastodonClient requests public statuses from Mastodon instances
+type mastodonClient struct {
+	http *http.Client
+
+	// accounts caches the accounts that have been looked up by user@instance
+	mu       sync.Mutex
+	accounts map[string]mastodonAccount
+}
+
+func newMastodonClient() *mastodonClient {
+	return &mastodonClient{
+		http:     &http.Client{Timeout: 30 * time.Second},
+		accounts: make(map[string]mastodonAccount),
+	}
+}
+
+type mastodonAccount struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	Acct        string `json:"acct"`
+	DisplayName string `json:"display_name"`
+	URL         string `json:"url"`
+	Avatar      string `json:"avatar"`
+	// FollowersCount is used to normalise the engagement score, see engagementScore
+	FollowersCount int `json:"followers_count"`
+}
+
+type mastodonStatus struct {
+	ID                 string          `json:"id"`
+	URL                string          `json:"url"`
+	URI                string          `json:"uri"`
+	CreatedAt          time.Time       `json:"created_at"`
+	InReplyToID        string          `json:"in_reply_to_id"`
+	InReplyToAccountID string          `json:"in_reply_to_account_id"`
+	Content            string          `json:"content"`
+	SpoilerText        string          `json:"spoiler_text"`
+	Language           string          `json:"language"`
+	ReblogsCount       int             `json:"reblogs_count"`
+	FavouritesCount    int             `json:"favourites_count"`
+	Account            mastodonAccount `json:"account"`
+	Reblog             *mastodonStatus `json:"reblog"`
+	MediaAttachments   []mastodonMedia `json:"media_attachments"`
+	Application        struct {
+		Name string `json:"name"`
+	} `json:"application"`
+}
+
+type mastodonMedia struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	PreviewURL string `json:"preview_url"`
+}
+
+// lookup resolves user@instance to the account on the instance
+func (c *mastodonClient) lookup(ctx context.Context, instance, user string) (mastodonAccount, error) {
+	key := strings.ToLower(user + "@" + instance)
+
+	c.mu.Lock()
+	account, ok := c.accounts[key]
+	c.mu.Unlock()
+	if ok {
+		return account, nil
+	}
+
+	u := "https://" + instance + "/api/v1/accounts/lookup?acct=" + url.QueryEscape(user)
+	if err := getJSON(ctx, c.http, u, nil, &account); err != nil {
+		return account, err
+	}
+
+	c.mu.Lock()
+	c.accounts[key] = account
+	c.mu.Unlock()
+
+	return account, nil
+}
+
+// mastodonSource retrieves the public statuses of a Mastodon account
+type mastodonSource struct {
+	app    app
+	client *mastodonClient
+	source timelineSource
+}
+
+// Page requests a single page of statuses using max_id, retrying according to the retry policy
+func (m mastodonSource) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	a, s := m.app, m.source
+
+	var account mastodonAccount
+	err := a.Config.Retry.do(ctx, "accounts/lookup "+s.Name, func() error {
+		var err error
+		account, err = m.client.lookup(ctx, s.Instance, strings.TrimSuffix(s.Name, "@"+s.Instance))
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	count := a.Config.TweetCount
+	if count > maxMastodonCount {
+		count = maxMastodonCount
+	}
+	v := url.Values{}
+	v.Set("limit", strconv.Itoa(count))
+	if !a.Config.IncludeRetweets {
+		v.Set("exclude_reblogs", "true")
+	}
+	if sinceID > 0 {
+		v.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if cursor != "" {
+		v.Set("max_id", cursor)
+	}
+
+	var statuses []mastodonStatus
+	u := "https://" + s.Instance + "/api/v1/accounts/" + url.PathEscape(account.ID) + "/statuses?" + v.Encode()
+	err = a.Config.Retry.do(ctx, "accounts/statuses "+s.Name, func() error {
+		statuses = nil
+		return getJSON(ctx, m.client.http, u, nil, &statuses)
+	})
+	log.Debug().Int("tweet-count", len(statuses)).Str("source", s.String()).Str("max_id", cursor).Msg("pulled down statuses")
+	if err != nil || len(statuses) == 0 {
+		return nil, "", err
+	}
+
+	tweets := make([]anaconda.Tweet, len(statuses))
+	for i, status := range statuses {
+		tweets[i] = status.convert(s.Instance)
+	}
+
+	return tweets, statuses[len(statuses)-1].ID, nil
+}
+
+// Parent requests the status a reply responds to from the instance of the account, retrying according to the
+// retry policy
+func (m mastodonSource) Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error) {
+	var status mastodonStatus
+	u := "https://" + m.source.Instance + "/api/v1/statuses/" + url.PathEscape(reply.InReplyToStatusIdStr)
+	err := m.app.Config.Retry.do(ctx, "statuses "+reply.InReplyToStatusIdStr, func() error {
+		status = mastodonStatus{}
+		return getJSON(ctx, m.client.http, u, nil, &status)
+	})
+	if err != nil {
+		return anaconda.Tweet{}, err
+	}
+	return status.convert(m.source.Instance), nil
+}
+
+// convert maps a status into the model consumed by the templates. Boosts are mapped onto retweets.
+func (st mastodonStatus) convert(instance string) anaconda.Tweet {
+	body := st.Content
+	if st.SpoilerText != "" {
+		// keep the content warning in front of the text
+		body = "<p>CW: " + html.EscapeString(st.SpoilerText) + "</p>" + body
+	}
+	content := textFromHTML(body)
+
+	tweet := anaconda.Tweet{
+		IdStr:                st.URL,
+		FullText:             content.Text,
+		Text:                 content.Text,
+		CreatedAt:            createdAt(st.CreatedAt),
+		Lang:                 st.Language,
+		Source:               twitterEscaper.Replace(st.Application.Name),
+		RetweetCount:         st.ReblogsCount,
+		FavoriteCount:        st.FavouritesCount,
+		InReplyToStatusIdStr: st.InReplyToID,
+		InReplyToUserIdStr:   st.InReplyToAccountID,
+		User:                 st.Account.user(instance),
+	}
+	if tweet.IdStr == "" {
+		tweet.IdStr = st.URI
+	}
+	tweet.Id, _ = strconv.ParseInt(st.ID, 10, 64)
+	tweet.InReplyToStatusID, _ = strconv.ParseInt(st.InReplyToID, 10, 64)
+	tweet.InReplyToUserID, _ = strconv.ParseInt(st.InReplyToAccountID, 10, 64)
+	tweet.Entities.Urls = content.Urls
+	tweet.Entities.User_mentions = content.Mentions
+
+	for _, m := range st.MediaAttachments {
+		img := m.URL
+		if m.Type != "image" {
+			img = m.PreviewURL
+		}
+		if img = safeURL(img); img != "" {
+			tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(img, m.Type))
+		}
+	}
+
+	if st.Reblog != nil {
+		reblog := st.Reblog.convert(instance)
+		tweet.RetweetedStatus = &reblog
+		tweet.FullText = "RT @" + reblog.User.ScreenName + ": " + reblog.FullText
+		tweet.Text = tweet.FullText
+		tweet.Entities = anaconda.Entities{}
+	}
+
+	return tweet
+}
+
+// user maps an account into the model consumed by the templates. Local accounts are qualified with the instance.
+func (acc mastodonAccount) user(instance string) anaconda.User {
+	screenName := acc.Acct
+	if !strings.Contains(screenName, "@") {
+		screenName += "@" + instance
+	}
+	name := acc.DisplayName
+	if name == "" {
+		name = acc.Username
+	}
+
+	u := anaconda.User{
+		IdStr:                acc.URL,
+		Name:                 name,
+		ScreenName:           screenName,
+		ProfileImageURL:      acc.Avatar,
+		ProfileImageUrlHttps: acc.Avatar,
+		FollowersCount:       acc.FollowersCount,
+	}
+	u.Id, _ = strconv.ParseInt(acc.ID, 10, 64)
+	return u
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ChimeraCoder/anaconda"
+	xhtml "golang.org/x/net/html"
+)
+
+// The sources that don't use anaconda map their posts into anaconda.Tweet, which is the model the templates
+// consume. Posts from other networks store the URL of the post in IdStr and the URL of the author's profile in
+// User.IdStr, see permalink and profileURL. The numeric Id is used to track the delivered posts.
+//
+// anaconda declares the entities as anonymous structs, these aliases make them usable by name.
+type (
+	urlEntity = struct {
+		Indices      []int  `json:"indices"`
+		Url          string `json:"url"`
+		Display_url  string `json:"display_url"`
+		Expanded_url string `json:"expanded_url"`
+	}
+	hashtagEntity = struct {
+		Indices []int  `json:"indices"`
+		Text    string `json:"text"`
+	}
+	mentionEntity = struct {
+		Name        string `json:"name"`
+		Indices     []int  `json:"indices"`
+		Screen_name string `json:"screen_name"`
+		Id          int64  `json:"id"`
+		Id_str      string `json:"id_str"`
+	}
+)
+
+// createdAt formats a time the way the Twitter API v1.1 does so Tweet.CreatedAtTime can parse it
+func createdAt(t time.Time) string {
+	return t.UTC().Format(time.RubyDate)
+}
+
+// unixMilli returns the time in milliseconds since the epoch, which is used as the ID of posts without a numeric ID
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// mediaEntity returns the entity for an image attached to a post
+func mediaEntity(imageURL, mediaType string) anaconda.EntityMedia {
+	return anaconda.EntityMedia{
+		Media_url:       imageURL,
+		Media_url_https: imageURL,
+		Expanded_url:    imageURL,
+		Type:            mediaType,
+	}
+}
+
+// isURL reports whether an ID is the URL of a post or profile from a network other than Twitter
+func isURL(id string) bool {
+	return strings.HasPrefix(id, "https://") || strings.HasPrefix(id, "http://")
+}
+
+// isDataURI reports whether an image is embedded as a data URI, see embedArchiveMedia
+func isDataURI(src string) bool {
+	return strings.HasPrefix(src, "data:image/")
+}
+
+// permalink returns the URL of a post
+func permalink(t anaconda.Tweet) string {
+	if isURL(t.IdStr) {
+		return t.IdStr
+	}
+	return "https://twitter.com/" + url.PathEscape(t.User.ScreenName) + "/status/" + strconv.FormatInt(t.Id, 10)
+}
+
+// profileURL returns the URL of the profile of an account
+func profileURL(u anaconda.User) string {
+	if isURL(u.IdStr) {
+		return u.IdStr
+	}
+	return "https://twitter.com/" + url.PathEscape(u.ScreenName)
+}
+
+// hashID derives a numeric ID from the ID of an account or entry on another network so they can be told apart
+func hashID(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64() >> 1)
+}
+
+// isReply reports whether a tweet is a reply. Replies in feeds only name the account they respond to, not the tweet.
+func isReply(t anaconda.Tweet) bool {
+	return t.InReplyToStatusIdStr != "" || t.InReplyToScreenName != ""
+}
+
+// appendURL links a URL from the text of the tweet, unless the text already links to it
+func appendURL(t *anaconda.Tweet, u string) {
+	if u = safeURL(u); u == "" {
+		return
+	}
+	for _, e := range t.Entities.Urls {
+		if e.Expanded_url == u {
+			return
+		}
+	}
+
+	if t.FullText != "" {
+		t.FullText += " "
+	}
+	start := utf8.RuneCountInString(t.FullText)
+	t.FullText += twitterEscaper.Replace(u)
+	t.Text = t.FullText
+	t.Entities.Urls = append(t.Entities.Urls, urlEntity{Indices: []int{start, utf8.RuneCountInString(t.FullText)}, Url: u, Display_url: u, Expanded_url: u})
+}
+
+// twitterEscaper escapes text the same way Twitter escapes the text of tweets
+var twitterEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// htmlText is the text and the entities extracted from the HTML content of a post
+type htmlText struct {
+	// Text is escaped the same way as the text of tweets and the entity indices refer to it
+	Text     string
+	Urls     []urlEntity
+	Mentions []mentionEntity
+	// Images are the sources of the images embedded in the content
+	Images []string
+}
+
+// textFromHTML converts the HTML content of a post into text. Links whose text starts with @ become mentions linked
+// to the href, hashtags are kept as plain text and all other links become URL entities.
+func textFromHTML(content string) htmlText {
+	var (
+		h          htmlText
+		buf        strings.Builder
+		runes      int
+		linkStart  = -1
+		linkHref   string
+		linkText   strings.Builder
+		skipText   int
+		z          = xhtml.NewTokenizer(strings.NewReader(content))
+		writeRunes = func(s string) {
+			s = twitterEscaper.Replace(s)
+			buf.WriteString(s)
+			runes += utf8.RuneCountInString(s)
+		}
+	)
+
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+
+		tok := z.Token()
+		switch tt {
+		case xhtml.TextToken:
+			if skipText > 0 {
+				continue
+			}
+			if linkStart >= 0 {
+				linkText.WriteString(tok.Data)
+			}
+			writeRunes(tok.Data)
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			switch tok.Data {
+			case "script", "style":
+				if tt == xhtml.StartTagToken {
+					skipText++
+				}
+			case "br":
+				writeRunes("\n")
+			case "p", "div", "li", "blockquote":
+				if runes > 0 && !strings.HasSuffix(buf.String(), "\n\n") {
+					writeRunes("\n\n")
+				}
+			case "a":
+				linkStart, linkHref = runes, attr(tok, "href")
+				linkText.Reset()
+			case "img":
+				if src := safeURL(attr(tok, "src")); src != "" {
+					h.Images = append(h.Images, src)
+				}
+			}
+		case xhtml.EndTagToken:
+			switch tok.Data {
+			case "p", "div", "li", "blockquote":
+				// text following a block doesn't necessarily start with another block
+				if runes > 0 && !strings.HasSuffix(buf.String(), "\n\n") {
+					writeRunes("\n\n")
+				}
+			case "script", "style":
+				if skipText > 0 {
+					skipText--
+				}
+			case "a":
+				if linkStart < 0 || linkStart == runes {
+					linkStart = -1
+					continue
+				}
+				indices := []int{linkStart, runes}
+				text := strings.TrimSpace(linkText.String())
+				switch {
+				case strings.HasPrefix(text, "@"):
+					h.Mentions = append(h.Mentions, mentionEntity{Indices: indices, Screen_name: strings.TrimPrefix(text, "@"), Id_str: safeURL(linkHref)})
+				case strings.HasPrefix(text, "#"):
+				default:
+					if href := safeURL(linkHref); href != "" {
+						h.Urls = append(h.Urls, urlEntity{Indices: indices, Url: href, Display_url: text, Expanded_url: href})
+					}
+				}
+				linkStart = -1
+			}
+		}
+	}
+
+	// only trailing whitespace can be trimmed without shifting the entity indices
+	h.Text = strings.TrimRightFunc(buf.String(), func(r rune) bool { return r == '\n' || r == ' ' })
+	return h
+}
+
+// attr returns the value of an attribute of a token
+func attr(tok xhtml.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTextFromHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		html     string
+		text     string
+		urls     [][]int
+		mentions []string
+		images   []string
+	}{
+		{
+			name: "paragraphs",
+			html: "<p>one</p><p>two<br>three</p>",
+			text: "one\n\ntwo\nthree",
+		},
+		{
+			name: "text after a paragraph",
+			html: "<p>Title</p>body",
+			text: "Title\n\nbody",
+		},
+		{
+			name: "escaped like a tweet",
+			html: "<p>a &amp; b &lt;c&gt;</p><script>alert(1)</script>",
+			text: "a &amp; b &lt;c&gt;",
+		},
+		{
+			name:     "links, mentions and hashtags",
+			html:     `<p><a href="https://mastodon.social/@Gargron">@<span>Gargron</span></a> <a href="https://mastodon.social/tags/go">#go</a> <a href="https://go.dev/">go.dev</a></p>`,
+			text:     "@Gargron #go go.dev",
+			urls:     [][]int{{13, 19}},
+			mentions: []string{"Gargron"},
+		},
+		{
+			name: "unsafe links are dropped",
+			html: `<a href="javascript:alert(1)">click</a>`,
+			text: "click",
+		},
+		{
+			name:   "images",
+			html:   `<p>look</p><img src="https://example.com/a.png"><img src="data:image/png;base64,AA">`,
+			text:   "look",
+			images: []string{"https://example.com/a.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := textFromHTML(tt.html)
+			if got.Text != tt.text {
+				t.Errorf("text = %q, want %q", got.Text, tt.text)
+			}
+
+			var urls [][]int
+			for _, u := range got.Urls {
+				urls = append(urls, u.Indices)
+			}
+			var mentions []string
+			for _, m := range got.Mentions {
+				mentions = append(mentions, m.Screen_name)
+			}
+			if !reflect.DeepEqual(urls, tt.urls) || !reflect.DeepEqual(mentions, tt.mentions) || !reflect.DeepEqual(got.Images, tt.images) {
+				t.Errorf("urls %v, mentions %v, images %v, want %v, %v, %v", urls, mentions, got.Images, tt.urls, tt.mentions, tt.images)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"gopkg.in/gomail.v2"
+)
+
+// formats supported by --output-format
+const (
+	outputHTML = "html"
+	outputText = "text"
+	outputEML  = "eml"
+)
+
+// writeDigest writes the digest in the requested format to path, or to stdout if path is empty.
+// The eml format writes the complete RFC 5322 message including the headers and both parts.
+func writeDigest(path, format string, m *gomail.Message, html, text string) error {
+	if path == "" {
+		return writeDigestTo(os.Stdout, format, m, html, text)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeDigestTo(f, format, m, html, text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeDigestTo(w io.Writer, format string, m *gomail.Message, html, text string) error {
+	var err error
+	switch format {
+	case outputEML:
+		_, err = m.WriteTo(w)
+	case outputText:
+		_, err = io.WriteString(w, text)
+	default:
+		_, err = io.WriteString(w, html)
+	}
+	return err
+}
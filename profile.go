@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+	"gopkg.in/gomail.v2"
+)
+
+// profile is a named digest from the digests list in the config file.
+// Settings that aren't set in the profile fall back to the command line flags and the global config.
+type profile struct {
+	Name            string        `mapstructure:"name"`
+	Accounts        []string      `mapstructure:"accounts"`
+	Duration        time.Duration `mapstructure:"duration"`
+	SinceLast       *bool         `mapstructure:"since_last"`
+	IncludeRetweets *bool         `mapstructure:"include_retweets"`
+	IncludeReplies  *bool         `mapstructure:"include_replies"`
+	OnThisDay       *bool         `mapstructure:"on_this_day"`
+	Offline         *bool         `mapstructure:"offline"`
+	MinFavorites    *int          `mapstructure:"min_favorites"`
+	MinRetweets     *int          `mapstructure:"min_retweets"`
+	Top             *int          `mapstructure:"top"`
+	Highlights      *int          `mapstructure:"highlights"`
+	Threads         *bool         `mapstructure:"threads"`
+	EmailTo         []string      `mapstructure:"email_to"`
+	Subject         string        `mapstructure:"subject"`
+	Template        string        `mapstructure:"template"`
+	TextTemplate    string        `mapstructure:"text_template"`
+	TemplateDir     string        `mapstructure:"template_dir"`
+	// Schedule is the cron expression used by the daemon, evaluated in Timezone (the local timezone if empty)
+	Schedule string `mapstructure:"schedule"`
+	Timezone string `mapstructure:"timezone"`
+	// the filter rules apply to all accounts in addition to the rules given on the command line,
+	// AccountFilters apply to single entries of Accounts
+	Filters        filterRules            `mapstructure:",squash"`
+	AccountFilters map[string]filterRules `mapstructure:"account_filters"`
+}
+
+// profile names are used in the state file and in output file names
+var profileNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// loadProfiles reads and validates the digests list from the config file
+func loadProfiles() ([]profile, error) {
+	var profiles []profile
+	if err := viper.UnmarshalKey("digests", &profiles); err != nil {
+		return nil, fmt.Errorf("reading digests: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("digest #%d does not have a name", i+1)
+		}
+		if !profileNameRE.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid digest name %q, only letters, digits, '.', '-' and '_' are allowed", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("digest %s is defined more than once", p.Name)
+		}
+		seen[p.Name] = true
+
+		if len(p.Accounts) == 0 {
+			return nil, fmt.Errorf("digest %s does not have any accounts", p.Name)
+		}
+		if err := validateSources(p.Accounts); err != nil {
+			return nil, fmt.Errorf("digest %s: %w", p.Name, err)
+		}
+		if _, err := texttemplate.New("subject").Parse(p.Subject); err != nil {
+			return nil, fmt.Errorf("parsing the subject of digest %s: %w", p.Name, err)
+		}
+		if _, _, err := p.schedule(); err != nil {
+			return nil, fmt.Errorf("digest %s: %w", p.Name, err)
+		}
+		if _, err := p.filters(filterRules{}); err != nil {
+			return nil, fmt.Errorf("digest %s: %w", p.Name, err)
+		}
+		for _, n := range []*int{p.MinFavorites, p.MinRetweets, p.Top, p.Highlights} {
+			if n != nil && *n < 0 {
+				return nil, fmt.Errorf("digest %s: min_favorites, min_retweets, top and highlights can't be negative", p.Name)
+			}
+		}
+	}
+
+	return profiles, nil
+}
+
+// selectProfiles returns the digests to run. Without --profile or --all-profiles a single unnamed digest
+// is built from the usernames on the command line.
+func selectProfiles(name string, all bool, users []string) ([]profile, error) {
+	if name == "" && !all {
+		if len(users) < 1 {
+			return nil, errors.New("twitter screenname was not provided")
+		}
+		if err := validateSources(users); err != nil {
+			return nil, err
+		}
+		return []profile{{Accounts: users}}, nil
+	}
+
+	if len(users) > 0 {
+		return nil, errors.New("usernames can't be combined with --profile or --all-profiles")
+	}
+	if name != "" && all {
+		return nil, errors.New("--profile and --all-profiles can't be combined")
+	}
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if all {
+		if len(profiles) == 0 {
+			return nil, errors.New("no digests are defined in the config file")
+		}
+		return profiles, nil
+	}
+
+	for _, p := range profiles {
+		if p.Name == name {
+			return []profile{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("digest %s is not defined in the config file", name)
+}
+
+// withProfile returns a copy of the app with the settings of the profile applied and its templates loaded.
+// The copy shares the Twitter client, state and link cache with the original.
+func (a app) withProfile(p profile) (app, error) {
+	a.Config.Profile = p.Name
+	if p.Duration != 0 {
+		a.Config.Threshold = p.Duration
+	}
+	if p.SinceLast != nil {
+		a.Config.SinceLast = *p.SinceLast
+	}
+	if p.IncludeRetweets != nil {
+		a.Config.IncludeRetweets = *p.IncludeRetweets
+	}
+	if p.IncludeReplies != nil {
+		a.Config.IncludeReplies = *p.IncludeReplies
+	}
+	if p.OnThisDay != nil {
+		a.Config.OnThisDay = *p.OnThisDay
+	}
+	if p.Offline != nil {
+		a.Config.Offline = *p.Offline
+	}
+	if p.MinFavorites != nil {
+		a.Config.MinFavorites = *p.MinFavorites
+	}
+	if p.MinRetweets != nil {
+		a.Config.MinRetweets = *p.MinRetweets
+	}
+	if p.Top != nil {
+		a.Config.TopN = *p.Top
+	}
+	if p.Highlights != nil {
+		a.Config.Highlights = *p.Highlights
+	}
+	if p.Threads != nil {
+		a.Config.Threads = *p.Threads
+	}
+	if len(p.EmailTo) > 0 {
+		a.Config.EmailTo = p.EmailTo
+	}
+	if p.Template != "" {
+		a.Config.TemplateFile = p.Template
+	}
+	if p.TextTemplate != "" {
+		a.Config.TextTemplateFile = p.TextTemplate
+	}
+	if p.TemplateDir != "" {
+		a.Config.TemplateDir = p.TemplateDir
+	}
+
+	var err error
+	if a.Filters, err = p.filters(a.Config.Filter); err != nil {
+		return a, err
+	}
+	a.Templates, err = a.loadTemplates()
+	return a, err
+}
+
+// filters compiles the filter rules of the command line (base), the profile and its accounts
+func (p profile) filters(base filterRules) (digestFilters, error) {
+	var f digestFilters
+	if err := f.add(base); err != nil {
+		return f, err
+	}
+	if err := f.add(p.Filters); err != nil {
+		return f, err
+	}
+
+	for entry, rules := range p.AccountFilters {
+		found := false
+		for _, account := range p.Accounts {
+			found = found || strings.EqualFold(account, entry)
+		}
+		if !found {
+			return f, fmt.Errorf("account_filters: %s is not one of the accounts", entry)
+		}
+		if err := f.addEntry(entry, rules); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// schedule parses the cron expression and timezone of the profile. The schedule is nil if the profile isn't scheduled.
+func (p profile) schedule() (cron.Schedule, *time.Location, error) {
+	loc := time.Local
+	if p.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(p.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	if p.Schedule == "" {
+		return nil, loc, nil
+	}
+
+	sched, err := cron.ParseStandard(p.Schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule: %w", err)
+	}
+
+	return sched, loc, nil
+}
+
+// stateKey returns the key used to track the delivered tweets of a screen name.
+// Profiles track their state separately so an account can be part of several digests.
+func (a app) stateKey(screenName string) string {
+	if a.Config.Profile == "" {
+		return screenName
+	}
+	return a.Config.Profile + "/" + screenName
+}
+
+// stateKeys returns the state keys of all the accounts in a digest
+func (a app) stateKeys(users []string) []string {
+	keys := make([]string, len(users))
+	for i, u := range users {
+		keys[i] = a.stateKey(u)
+	}
+	return keys
+}
+
+// subject returns the subject of the digest email. The subject configured in a profile is a template that
+// can use .Name, .Accounts and .Date.
+func (p profile) subject(now time.Time) (string, error) {
+	if p.Subject == "" {
+		labels := make([]string, len(p.Accounts))
+		sep := "/"
+		for i, entry := range p.Accounts {
+			source, _ := parseSource(entry)
+			labels[i] = source.String()
+			// list slugs already contain a slash
+			if !source.account() {
+				sep = ", "
+			}
+		}
+		return fmt.Sprintf("%s Tweet Digest for %s", strings.Join(labels, sep), now.Format("1/2/06")), nil
+	}
+
+	t, err := texttemplate.New("subject").Parse(p.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	err = t.Execute(&buf, struct {
+		Name     string
+		Accounts []string
+		Date     string
+	}{p.Name, p.Accounts, now.Format("1/2/06")})
+
+	return buf.String(), err
+}
+
+// outputPath returns the file a digest is written to by --output. When several digests are written,
+// the profile name is added to the file name (digest.html becomes digest-name.html).
+func (p profile) outputPath(path string, multiple bool) string {
+	if path == "" || !multiple || p.Name == "" {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + p.Name + ext
+}
+
+// renderedDigest is a digest that is ready to be delivered
+type renderedDigest struct {
+	app     app
+	profile profile
+	message *gomail.Message
+}
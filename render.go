@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ChimeraCoder/anaconda"
+	xhtml "golang.org/x/net/html"
+)
+
+// textLink is a range of a tweet's text (in runes) that is rendered as a link
+type textLink struct {
+	start, end int
+	href       string
+	text       string
+}
+
+// textSegment is a piece of a tweet's text. Segments with an href are rendered as links.
+type textSegment struct {
+	text string
+	href string
+}
+
+// segments splits the text of a tweet into plain text and links using the URL, mention, hashtag and media entities.
+// URLs that aren't covered by an entity are detected with urlRE. All URLs are unshortened.
+func (e emailBody) segments(t anaconda.Tweet) []textSegment {
+	var links []textLink
+
+	for _, u := range t.Entities.Urls {
+		if len(u.Indices) == 2 {
+			final := e.finalURL(u.Expanded_url)
+			links = append(links, textLink{start: u.Indices[0], end: u.Indices[1], href: final, text: final})
+		}
+	}
+	for _, m := range t.Entities.Media {
+		if len(m.Indices) == 2 {
+			links = append(links, textLink{start: m.Indices[0], end: m.Indices[1], href: m.Expanded_url, text: m.Expanded_url})
+		}
+	}
+	for _, m := range t.Entities.User_mentions {
+		if len(m.Indices) == 2 {
+			links = append(links, textLink{start: m.Indices[0], end: m.Indices[1], href: profileURL(anaconda.User{ScreenName: m.Screen_name, IdStr: m.Id_str}), text: "@" + m.Screen_name})
+		}
+	}
+	for _, h := range t.Entities.Hashtags {
+		if len(h.Indices) == 2 {
+			links = append(links, textLink{start: h.Indices[0], end: h.Indices[1], href: "https://twitter.com/hashtag/" + url.PathEscape(h.Text), text: "#" + h.Text})
+		}
+	}
+
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	var segments []textSegment
+	text := []rune(t.FullText)
+	pos := 0
+	for _, l := range links {
+		// ignore entities with offsets that don't match the text
+		if l.start < pos || l.end > len(text) || l.start >= l.end {
+			continue
+		}
+		segments = append(segments, e.plainSegments(string(text[pos:l.start]))...)
+		segments = append(segments, textSegment{text: l.text, href: l.href})
+		pos = l.end
+	}
+	segments = append(segments, e.plainSegments(string(text[pos:]))...)
+
+	return segments
+}
+
+// plainSegments splits a fragment of tweet text that isn't covered by an entity, detecting any URLs in it
+func (e emailBody) plainSegments(s string) []textSegment {
+	// Twitter returns the text with &, < and > already escaped
+	s = html.UnescapeString(s)
+
+	var segments []textSegment
+	pos := 0
+	for _, m := range urlRE.FindAllStringIndex(s, -1) {
+		final := e.finalURL(s[m[0]:m[1]])
+		segments = append(segments, textSegment{text: s[pos:m[0]]}, textSegment{text: final, href: final})
+		pos = m[1]
+	}
+
+	return append(segments, textSegment{text: s[pos:]})
+}
+
+// renderText escapes the text of a tweet and turns the URL, mention, hashtag and media entities into links
+func (e emailBody) renderText(t anaconda.Tweet) template.HTML {
+	var buf strings.Builder
+	for _, seg := range e.segments(t) {
+		if seg.href == "" {
+			buf.WriteString(template.HTMLEscapeString(seg.text))
+			continue
+		}
+		writeLink(&buf, seg.href, seg.text)
+	}
+
+	return template.HTML(buf.String())
+}
+
+// plainText returns the text of a tweet with the links expanded, for use in the plain text email
+func (e emailBody) plainText(t anaconda.Tweet) string {
+	var buf strings.Builder
+	for _, seg := range e.segments(t) {
+		buf.WriteString(seg.text)
+	}
+
+	return buf.String()
+}
+
+// writeLink writes an escaped anchor, or only the escaped text if the URL isn't safe to link to
+func writeLink(buf *strings.Builder, href, text string) {
+	href = safeURL(href)
+	if href == "" {
+		buf.WriteString(template.HTMLEscapeString(text))
+		return
+	}
+
+	buf.WriteString(`<a href="`)
+	buf.WriteString(template.HTMLEscapeString(href))
+	buf.WriteString(`" target="_blank" style="color:#348eda; text-decoration:None">`)
+	buf.WriteString(template.HTMLEscapeString(text))
+	buf.WriteString(`</a>`)
+}
+
+// safeURL returns the URL if it is an absolute http(s) URL, otherwise an empty string
+func safeURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// resolveURL resolves a possibly relative URL found on the page at base and validates it with safeURL
+func resolveURL(base, raw string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return safeURL(raw)
+	}
+	u, err := b.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return ""
+	}
+	return safeURL(u.String())
+}
+
+// cleanText collapses the whitespace in scraped text and limits its length
+func cleanText(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max]) + "…"
+	}
+	return s
+}
+
+// elements (and the attributes for them) that are allowed to pass through sanitizeHTML
+var allowedElements = map[string][]string{
+	"a":          {"href"},
+	"blockquote": nil,
+	"p":          nil,
+	"br":         nil,
+	"em":         nil,
+	"strong":     nil,
+	"b":          nil,
+	"i":          nil,
+	"span":       nil,
+}
+
+// sanitizeHTML keeps only a small set of formatting elements from untrusted HTML (e.g. oEmbed responses).
+// Scripts and styles are dropped entirely and links are restricted to http(s) URLs.
+func sanitizeHTML(s string) template.HTML {
+	var buf bytes.Buffer
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	skip := 0
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			if z.Err() != io.EOF {
+				return ""
+			}
+			return template.HTML(buf.String())
+		case xhtml.TextToken:
+			if skip == 0 {
+				buf.WriteString(template.HTMLEscapeString(string(z.Text())))
+			}
+		case xhtml.StartTagToken, xhtml.EndTagToken, xhtml.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "script" || tok.Data == "style" {
+				if tt == xhtml.StartTagToken {
+					skip++
+				} else if tt == xhtml.EndTagToken && skip > 0 {
+					skip--
+				}
+				continue
+			}
+
+			attrs, ok := allowedElements[tok.Data]
+			if !ok || skip > 0 {
+				continue
+			}
+
+			if tt == xhtml.EndTagToken {
+				buf.WriteString("</" + tok.Data + ">")
+				continue
+			}
+
+			buf.WriteString("<" + tok.Data)
+			for _, attr := range tok.Attr {
+				for _, allowed := range attrs {
+					if attr.Key != allowed {
+						continue
+					}
+					if v := safeURL(attr.Val); v != "" {
+						buf.WriteString(" " + attr.Key + `="` + template.HTMLEscapeString(v) + `"`)
+					}
+				}
+			}
+			buf.WriteString(">")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"strconv"
+	"testing"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+func TestRenderText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// expanded is the expanded URL of the t.co link in the text
+		expanded string
+		want     template.HTML
+	}{
+		{
+			name: "escaped script",
+			text: "&lt;script&gt;alert(1)&lt;/script&gt;",
+			want: "&lt;script&gt;alert(1)&lt;/script&gt;",
+		},
+		{
+			name:     "attribute injection in an expanded URL",
+			text:     "see https://t.co/x",
+			expanded: `https://example.com/"onmouseover="alert(1)`,
+			want:     `see <a href="https://example.com/%22onmouseover=%22alert%281%29" target="_blank" style="color:#348eda; text-decoration:None">https://example.com/&#34;onmouseover=&#34;alert(1)</a>`,
+		},
+		{
+			name:     "javascript URL is not linked",
+			text:     "see https://t.co/x",
+			expanded: "javascript:alert(1)",
+			want:     "see javascript:alert(1)",
+		},
+		{
+			name:     "data URL is not linked",
+			text:     "see https://t.co/x",
+			expanded: "data:text/html,<script>alert(1)</script>",
+			want:     "see data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;",
+		},
+		{
+			name: "URL in the text is unshortened after unescaping",
+			text: "https://example.com/?a=1&amp;b=2 &amp; more",
+			want: `<a href="https://example.com/final" target="_blank" style="color:#348eda; text-decoration:None">https://example.com/final</a> &amp; more`,
+		},
+	}
+
+	e := emailBody{Links: map[string]*linkPreview{
+		"https://example.com/?a=1&b=2": {FinalURL: "https://example.com/final"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tweet := anaconda.Tweet{FullText: tt.text}
+			if tt.expanded != "" {
+				entities := `{"urls": [{"url": "https://t.co/x", "expanded_url": ` + strconv.Quote(tt.expanded) + `, "indices": [4, 18]}]}`
+				if err := json.Unmarshal([]byte(entities), &tweet.Entities); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := e.renderText(tweet); got != tt.want {
+				t.Errorf("renderText() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want template.HTML
+	}{
+		{`<p>hi<script>alert(1)</script></p>`, `<p>hi</p>`},
+		{`<style>p { color: red }</style><b>bold</b>`, `<b>bold</b>`},
+		{`<p onclick="alert(1)" class="x">text</p>`, `<p>text</p>`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`, `<a>x</a>`},
+		{`<a href="https://example.com/?a=1&amp;b=&quot;2">x</a>`, `<a href="https://example.com/?a=1&amp;b=&#34;2">x</a>`},
+		{`<iframe src="https://example.com"></iframe><img src=x onerror=alert(1)>`, ``},
+		{
+			`<blockquote class="twitter-tweet"><p lang="en" dir="ltr">Go 1.20 is out <a href="https://t.co/x">https://t.co/x</a></p>&mdash; Go (@golang) <a href="https://twitter.com/golang/status/1?ref_src=twsrc%5Etfw">February 1, 2023</a></blockquote>
+<script async src="https://platform.twitter.com/widgets.js" charset="utf-8"></script>`,
+			`<blockquote><p>Go 1.20 is out <a href="https://t.co/x">https://t.co/x</a></p>— Go (@golang) <a href="https://twitter.com/golang/status/1?ref_src=twsrc%5Etfw">February 1, 2023</a></blockquote>
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeHTML(tt.in); got != tt.want {
+			t.Errorf("sanitizeHTML(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://example.com/a":    "https://example.com/a",
+		" http://example.com ":     "http://example.com",
+		"javascript:alert(1)":      "",
+		"JAVASCRIPT:alert(1)":      "",
+		"data:image/png;base64,AA": "",
+		"//example.com/a":          "",
+		"/relative":                "",
+	} {
+		if got := safeURL(raw); got != want {
+			t.Errorf("safeURL(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// errorClass describes how a failed API request should be handled
+type errorClass int
+
+const (
+	// errTransient covers network failures and server side errors which are likely to succeed on a retry
+	errTransient errorClass = iota
+	// errRateLimited means the request should be retried once the rate limit window resets
+	errRateLimited
+	// errPermanent covers errors that will not go away by retrying (suspended, protected or missing accounts)
+	errPermanent
+)
+
+// Twitter error codes that aren't defined by anaconda
+const (
+	twitterErrorUserNotFound     = 50
+	twitterErrorAccountSuspended = 63
+)
+
+// retryPolicy controls how often and how long to wait when retrying failed API requests
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Limiter is shared by all workers so requests are spaced out and rate limits apply to everyone
+	Limiter *rateLimiter
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the exponential delay for the given attempt with jitter applied
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	// use "equal jitter" so that concurrent retries spread out without collapsing to zero
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitterRand.Int63n(int64(d/2)+1))
+}
+
+// do calls fn until it succeeds, returns a permanent error, the maximum number of attempts is reached
+// or the context is done
+func (p retryPolicy) do(ctx context.Context, desc string, fn func() error) error {
+	var err error
+
+	for attempt := 1; attempt <= p.MaxAttempts; attempt++ {
+		if waitErr := p.Limiter.Wait(ctx); waitErr != nil {
+			return waitErr
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		class, wait := classifyError(err)
+		if class == errPermanent || attempt == p.MaxAttempts {
+			break
+		}
+		if class == errRateLimited {
+			p.Limiter.Block(time.Now().Add(wait))
+		} else {
+			wait = p.backoff(attempt)
+		}
+
+		log.Warn().Err(err).Str("request", desc).Int("attempt", attempt).Dur("wait", wait).Bool("rate-limited", class == errRateLimited).Msg("request failed, retrying")
+		if sleepErr := sleepContext(ctx, wait); sleepErr != nil {
+			return sleepErr
+		}
+	}
+
+	return err
+}
+
+// classifyError determines whether an error is worth retrying. For rate limit errors the time to wait until
+// the limit resets is also returned.
+func classifyError(err error) (errorClass, time.Duration) {
+	var apiErr *anaconda.ApiError
+	if errors.As(err, &apiErr) {
+		if isRateLimited, nextWindow := apiErr.RateLimitCheck(); isRateLimited {
+			return errRateLimited, time.Until(nextWindow)
+		}
+
+		for _, e := range apiErr.Decoded.Errors {
+			switch e.Code {
+			case anaconda.TwitterErrorRateLimitExceeded:
+				// no reset header was supplied, wait for a full rate limit window
+				return errRateLimited, 15 * time.Minute
+			case anaconda.TwitterErrorDoesNotExist, anaconda.TwitterErrorDoesNotExist2, twitterErrorUserNotFound,
+				anaconda.TwitterErrorAccountSuspended, twitterErrorAccountSuspended,
+				anaconda.TwitterErrorCouldNotAuthenticate, anaconda.TwitterErrorInvalidToken, anaconda.TwitterErrorBadAuthenticationData:
+				return errPermanent, 0
+			}
+		}
+
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return errRateLimited, 15 * time.Minute
+		case apiErr.StatusCode >= 500:
+			return errTransient, 0
+		case apiErr.StatusCode >= 400:
+			return errPermanent, 0
+		}
+	}
+
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			if !httpErr.Reset.IsZero() {
+				return errRateLimited, time.Until(httpErr.Reset)
+			}
+			return errRateLimited, 15 * time.Minute
+		case httpErr.StatusCode >= 500:
+			return errTransient, 0
+		case httpErr.StatusCode >= 400:
+			return errPermanent, 0
+		}
+	}
+
+	// anything else, such as network failures, is assumed to be temporary
+	return errTransient, 0
+}
+
+// describeError turns an API error into a short explanation suitable for the digest
+func describeError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out before the timeline could be retrieved"
+	}
+
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized:
+			return "unable to authenticate with the API"
+		case http.StatusForbidden:
+			return "access to the timeline is not allowed"
+		case http.StatusNotFound:
+			return "the account does not exist"
+		case http.StatusTooManyRequests:
+			return "the API rate limit was exceeded"
+		}
+		if httpErr.Message != "" {
+			return httpErr.Message
+		}
+		return httpErr.Error()
+	}
+
+	var apiErr *anaconda.ApiError
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+
+	for _, e := range apiErr.Decoded.Errors {
+		switch e.Code {
+		case anaconda.TwitterErrorDoesNotExist, anaconda.TwitterErrorDoesNotExist2, twitterErrorUserNotFound:
+			return "the account does not exist"
+		case anaconda.TwitterErrorAccountSuspended, twitterErrorAccountSuspended:
+			return "the account is suspended"
+		case anaconda.TwitterErrorRateLimitExceeded:
+			return "the Twitter API rate limit was exceeded"
+		case anaconda.TwitterErrorCouldNotAuthenticate, anaconda.TwitterErrorInvalidToken, anaconda.TwitterErrorBadAuthenticationData:
+			return "unable to authenticate with the Twitter API"
+		}
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusUnauthorized:
+		return "the account is protected"
+	case http.StatusNotFound:
+		return "the account does not exist"
+	case http.StatusTooManyRequests:
+		return "the Twitter API rate limit was exceeded"
+	}
+
+	return apiErr.Error()
+}
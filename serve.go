@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadScript is injected into the previewed digest so the browser reloads when the templates change
+const reloadScript = `<script>
+(function() {
+	var version = "%VERSION%";
+	setInterval(function() {
+		fetch("/version").then(function(r) { return r.text(); }).then(function(v) {
+			if (v !== version) { location.reload(); }
+		});
+	}, 1000);
+})();
+</script>`
+
+// previewServer renders the digest for the configured users on every request
+type previewServer struct {
+	app   app
+	users []string
+
+	// fetchMu guards the fetched digest data
+	fetchMu sync.Mutex
+	body    emailBody
+	fetched time.Time
+
+	// mu guards the templates, which are reloaded in the background
+	mu          sync.Mutex
+	templates   digestTemplates
+	version     int
+	templateMod time.Time
+}
+
+// digestJSON is the JSON representation of the data passed to the templates
+type digestJSON struct {
+	Tweets []anaconda.Tweet `json:"tweets"`
+	// Threads are the tweets of each thread, oldest first, keyed by the ID of the first tweet
+	Threads   map[string][]anaconda.Tweet `json:"threads"`
+	Failed    map[string]string           `json:"failed"`
+	Truncated []string                    `json:"truncated"`
+	Links     map[string]*linkPreview     `json:"links"`
+}
+
+// serve starts the local preview server
+func (a app) serve(users []string) {
+	s := &previewServer{
+		app:         a,
+		users:       users,
+		templates:   a.Templates,
+		templateMod: a.templatesModTime(),
+	}
+
+	go s.watchTemplates()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHTML)
+	mux.HandleFunc("/text", s.handleText)
+	mux.HandleFunc("/tweets.json", s.handleJSON)
+	mux.HandleFunc("/version", s.handleVersion)
+
+	fmt.Printf("serving the digest preview on http://%s/ (plain text on /text, data on /tweets.json)\n", a.Config.Listen)
+	if err := http.ListenAndServe(a.Config.Listen, mux); err != nil {
+		log.Fatal().Err(err).Msg("error running preview server")
+	}
+}
+
+// digest returns the data for the preview along with an app configured with the current templates.
+// Timelines are only fetched again once --serve-refresh has passed or when ?refresh is requested.
+func (s *previewServer) digest(r *http.Request) (app, emailBody) {
+	s.fetchMu.Lock()
+	if s.fetched.IsZero() || time.Since(s.fetched) > s.app.Config.ServeRefresh || r.URL.Query().Get("refresh") != "" {
+		s.body = s.app.buildDigest(s.users)
+		s.fetched = time.Now()
+	}
+	body := s.body
+	s.fetchMu.Unlock()
+
+	s.mu.Lock()
+	a := s.app
+	a.Templates = s.templates
+	s.mu.Unlock()
+
+	return a, body
+}
+
+func (s *previewServer) handleHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	a, body := s.digest(r)
+	html := a.generateHTML(body)
+
+	s.mu.Lock()
+	script := strings.Replace(reloadScript, "%VERSION%", strconv.Itoa(s.version), 1)
+	s.mu.Unlock()
+
+	if i := strings.LastIndex(html, "</body>"); i >= 0 {
+		html = html[:i] + script + html[i:]
+	} else {
+		html += script
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(html))
+}
+
+func (s *previewServer) handleText(w http.ResponseWriter, r *http.Request) {
+	a, body := s.digest(r)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(a.generateText(body)))
+}
+
+func (s *previewServer) handleJSON(w http.ResponseWriter, r *http.Request) {
+	_, body := s.digest(r)
+
+	out := digestJSON{
+		Tweets:  body.Tweets,
+		Threads: make(map[string][]anaconda.Tweet, len(body.Threads)),
+		Failed:  make(map[string]string),
+		Links:   body.Links,
+	}
+	for id, t := range body.Threads {
+		out.Threads[id] = t.Tweets
+	}
+	for _, f := range body.Failed {
+		out.Failed[f.ScreenName] = f.Err.Error()
+	}
+	for _, t := range body.Truncated {
+		out.Truncated = append(out.Truncated, t.ScreenName)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Error().Err(err).Msg("error encoding tweets")
+	}
+}
+
+func (s *previewServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	version := s.version
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(strconv.Itoa(version)))
+}
+
+// watchTemplates polls the template files and reloads them when they change
+func (s *previewServer) watchTemplates() {
+	for range time.Tick(time.Second) {
+		mod := s.app.templatesModTime()
+		if !mod.After(s.templateMod) {
+			continue
+		}
+		s.templateMod = mod
+
+		templates, err := s.app.loadTemplates()
+		if err != nil {
+			log.Error().Err(err).Msg("error reloading templates")
+			continue
+		}
+
+		s.mu.Lock()
+		s.templates = templates
+		s.version++
+		s.mu.Unlock()
+		fmt.Println("reloaded templates")
+	}
+}
+
+// templatesModTime returns the most recent modification time of the configured template files and partials
+func (a app) templatesModTime() time.Time {
+	var latest time.Time
+
+	paths := []string{a.Config.TemplateFile, a.Config.TextTemplateFile, a.Config.TemplateDir}
+	if a.Config.TemplateDir != "" {
+		if entries, err := ioutil.ReadDir(a.Config.TemplateDir); err == nil {
+			for _, e := range entries {
+				paths = append(paths, filepath.Join(a.Config.TemplateDir, e.Name()))
+			}
+		}
+	}
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// kinds of timelines a digest can include
+const (
+	sourceUser   = "user"
+	sourceList   = "list"
+	sourceSearch = "search"
+	sourceHome   = "home"
+	sourceLikes  = "likes"
+	// sourceMastodon is the public timeline of a Mastodon account
+	sourceMastodon = "mastodon"
+	// sourceBluesky is the author feed of a Bluesky account
+	sourceBluesky = "bluesky"
+	// sourceFeed is an RSS or Atom feed
+	sourceFeed = "feed"
+	// sourceArchive is the archive of an account downloaded from Twitter
+	sourceArchive = "archive"
+)
+
+// timelineSource identifies the timeline of a digest entry. Entries are screen names, home (the home timeline of
+// the authenticated user), or list:<id>, list:<owner>/<slug>, search:<query> and likes:<screen name>. Mastodon
+// accounts are given as @user@instance or mastodon:user@instance, Bluesky accounts as bluesky:<handle> and RSS or
+// Atom feeds as feed:<url> or just the URL. Twitter archives are given as archive:<path to the ZIP file>.
+type timelineSource struct {
+	Kind string
+	// Name is the screen name, list ID, owner/slug, search query, user@instance, Bluesky handle, feed URL or the
+	// path of an archive. It is empty for the home timeline.
+	Name string
+	// ListID is set for lists given by ID
+	ListID int64
+	// Owner and Slug are set for lists given by owner and slug
+	Owner, Slug string
+	// Instance is the host name of the Mastodon instance
+	Instance string
+}
+
+// parseSource parses a digest entry
+func parseSource(entry string) (timelineSource, error) {
+	// a user called home can still be included as @home
+	if strings.EqualFold(entry, sourceHome) {
+		return timelineSource{Kind: sourceHome}, nil
+	}
+
+	i := strings.Index(entry, ":")
+	if i < 0 {
+		name := strings.TrimPrefix(entry, "@")
+		if name == "" {
+			return timelineSource{}, errors.New("empty screen name")
+		}
+		if strings.Contains(name, "@") {
+			return parseMastodon(entry, name)
+		}
+		return timelineSource{Kind: sourceUser, Name: name}, nil
+	}
+
+	s := timelineSource{Kind: strings.ToLower(entry[:i]), Name: strings.TrimSpace(entry[i+1:])}
+	if s.Name == "" {
+		return s, fmt.Errorf("%s: missing %s", entry, s.Kind)
+	}
+
+	switch s.Kind {
+	case sourceList:
+		if id, err := strconv.ParseInt(s.Name, 10, 64); err == nil {
+			s.ListID = id
+			return s, nil
+		}
+		parts := strings.Split(s.Name, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return s, fmt.Errorf("%s: expected a list ID or owner/slug", entry)
+		}
+		s.Owner, s.Slug = strings.TrimPrefix(parts[0], "@"), parts[1]
+		s.Name = s.Owner + "/" + s.Slug
+	case sourceSearch:
+	case sourceLikes, "favorites":
+		s.Kind = sourceLikes
+		s.Name = strings.TrimPrefix(s.Name, "@")
+	case sourceMastodon:
+		return parseMastodon(entry, strings.TrimPrefix(s.Name, "@"))
+	case sourceBluesky, "bsky":
+		s.Kind = sourceBluesky
+		s.Name = strings.ToLower(strings.TrimPrefix(s.Name, "@"))
+	case sourceFeed, "rss", "atom":
+		return parseFeed(entry, s.Name)
+	case "http", "https":
+		return parseFeed(entry, entry)
+	case sourceArchive:
+	case "bookmarks":
+		return s, fmt.Errorf("%s: bookmarks require OAuth 2.0 user authentication, which isn't supported", entry)
+	default:
+		return s, fmt.Errorf("%s: unknown source %q, expected list, search, likes, mastodon, bluesky, feed or archive", entry, s.Kind)
+	}
+
+	return s, nil
+}
+
+// parseMastodon parses the user@instance address of a Mastodon account
+func parseMastodon(entry, address string) (timelineSource, error) {
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[1], "/?#") {
+		return timelineSource{}, fmt.Errorf("%s: expected a Mastodon account as @user@instance", entry)
+	}
+	return timelineSource{Kind: sourceMastodon, Name: parts[0] + "@" + strings.ToLower(parts[1]), Instance: strings.ToLower(parts[1])}, nil
+}
+
+// parseFeed parses the URL of a feed
+func parseFeed(entry, rawURL string) (timelineSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return timelineSource{}, fmt.Errorf("%s: expected the http or https URL of a feed", entry)
+	}
+	return timelineSource{Kind: sourceFeed, Name: rawURL}, nil
+}
+
+// validateSources checks that all the entries of a digest can be parsed
+func validateSources(entries []string) error {
+	for _, e := range entries {
+		if _, err := parseSource(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the label used for the source in the digest
+func (s timelineSource) String() string {
+	switch s.Kind {
+	case sourceList:
+		return "list " + s.Name
+	case sourceSearch:
+		return strconv.Quote(s.Name)
+	case sourceHome:
+		return "home timeline"
+	case sourceLikes:
+		return "likes of @" + s.Name
+	case sourceFeed:
+		return "feed " + s.Name
+	case sourceArchive:
+		return "archive " + s.Name
+	default:
+		return "@" + s.Name
+	}
+}
+
+// account reports whether the source is the timeline of a single account
+func (s timelineSource) account() bool {
+	return s.Kind == sourceUser || s.Kind == sourceMastodon || s.Kind == sourceBluesky
+}
+
+// chronological reports whether the timeline is sorted by the creation time of the tweets. Likes are sorted by
+// the time they were liked, which isn't available from the API.
+func (s timelineSource) chronological() bool {
+	return s.Kind != sourceLikes
+}
+
+// tweetSource retrieves the tweets of a timeline one page at a time, newest first
+type tweetSource interface {
+	// Page returns a page of tweets newer than sinceID (if it is set) and the cursor of the next, older, page.
+	// An empty cursor requests the first page and is returned after the last page.
+	Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error)
+}
+
+// newSource returns the implementation of the timeline, Twitter timelines use the configured Twitter API
+func (a app) newSource(s timelineSource) (tweetSource, error) {
+	switch s.Kind {
+	case sourceMastodon:
+		return mastodonSource{app: a, client: a.Mastodon, source: s}, nil
+	case sourceBluesky:
+		return blueskySource{app: a, client: a.Bluesky, source: s}, nil
+	case sourceFeed:
+		return feedSource{app: a, client: a.Feeds, source: s}, nil
+	case sourceArchive:
+		return &archiveSource{app: a, source: s}, nil
+	}
+	if a.Config.TwitterAPI == twitterAPIv2 {
+		return a.TwitterV2.source(a, s)
+	}
+	return twitterV1Source{app: a, source: s}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	apppaths "github.com/muesli/go-app-paths"
+)
+
+// userState records what has already been delivered for a single screen name.
+// Screen names that are part of a digest profile are stored as "profile/screen name".
+type userState struct {
+	LastTweetID   int64     `json:"last_tweet_id"`
+	LastDelivered time.Time `json:"last_delivered"`
+}
+
+// stateStore persists the last delivered tweet per screen name so that consecutive runs
+// neither repeat nor skip tweets
+type stateStore struct {
+	path  string
+	mu    sync.Mutex
+	Users map[string]userState `json:"users"`
+	// Runs holds the time of the last scheduled run of each digest profile
+	Runs    map[string]time.Time `json:"runs,omitempty"`
+	pending map[string]int64
+}
+
+// defaultStatePath returns the location of the state file inside the user's data directory
+func defaultStatePath() (string, error) {
+	userScope := apppaths.NewScope(apppaths.User, "", "tweetdigest")
+	dataDir, err := userScope.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "state.json"), nil
+}
+
+// loadState reads the state file at path. A missing file results in an empty state.
+func loadState(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:    path,
+		Users:   make(map[string]userState),
+		Runs:    make(map[string]time.Time),
+		pending: make(map[string]int64),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Users == nil {
+		s.Users = make(map[string]userState)
+	}
+	if s.Runs == nil {
+		s.Runs = make(map[string]time.Time)
+	}
+
+	return s, nil
+}
+
+// LastTweetID returns the ID of the newest tweet delivered for the screen name, or 0 if nothing has been delivered yet
+func (s *stateStore) LastTweetID(screenName string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Users[strings.ToLower(screenName)].LastTweetID
+}
+
+// MarkSeen records the newest tweet ID fetched for a screen name. The value is only persisted once Commit is called.
+func (s *stateStore) MarkSeen(screenName string, id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(screenName)
+	if id > s.pending[key] {
+		s.pending[key] = id
+	}
+}
+
+// Commit merges the pending tweet IDs of the given keys into the state and writes it to disk.
+// Digests that are delivered together can be committed separately so a failed delivery doesn't advance the state.
+func (s *stateStore) Commit(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		user := strings.ToLower(k)
+		id, ok := s.pending[user]
+		if !ok {
+			continue
+		}
+		if id > s.Users[user].LastTweetID {
+			s.Users[user] = userState{LastTweetID: id, LastDelivered: now}
+		}
+		delete(s.pending, user)
+	}
+
+	return s.save()
+}
+
+// LastRun returns the time of the last scheduled run of a digest profile
+func (s *stateStore) LastRun(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.Runs[name]
+	return t, ok
+}
+
+// RecordRun stores the time of a scheduled run of a digest profile and writes the state to disk
+func (s *stateStore) RecordRun(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Runs[name] = t
+	return s.save()
+}
+
+// save writes the state file to disk
+func (s *stateStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place so readers
+// never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
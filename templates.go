@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	texttemplate "text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+// digestTemplates holds the parsed HTML and plain text templates used to render the digest.
+// The templates are cloned for every render so each digest gets its own template functions.
+type digestTemplates struct {
+	html *template.Template
+	text *texttemplate.Template
+}
+
+// loadTemplates parses the built-in templates, or the templates configured by the user, along with any partials
+// in the template directory (*.html files for the HTML template and *.txt files for the text template)
+func (a app) loadTemplates() (digestTemplates, error) {
+	var (
+		t   digestTemplates
+		err error
+	)
+	funcs := a.funcMap(emailBody{})
+
+	htmlSource, err := readTemplate(a.Config.TemplateFile, emailTemplate)
+	if err != nil {
+		return t, err
+	}
+	if t.html, err = template.New("emailTmpl").Funcs(funcs).Parse(htmlSource); err != nil {
+		return t, fmt.Errorf("parsing HTML template: %w", err)
+	}
+
+	textSource, err := readTemplate(a.Config.TextTemplateFile, textTemplate)
+	if err != nil {
+		return t, err
+	}
+	if t.text, err = texttemplate.New("textTmpl").Funcs(texttemplate.FuncMap(funcs)).Parse(textSource); err != nil {
+		return t, fmt.Errorf("parsing text template: %w", err)
+	}
+
+	if a.Config.TemplateDir == "" {
+		return t, nil
+	}
+
+	partials, err := filepath.Glob(filepath.Join(a.Config.TemplateDir, "*.html"))
+	if err != nil {
+		return t, err
+	}
+	if len(partials) > 0 {
+		if t.html, err = t.html.ParseFiles(partials...); err != nil {
+			return t, fmt.Errorf("parsing HTML partials: %w", err)
+		}
+	}
+
+	partials, err = filepath.Glob(filepath.Join(a.Config.TemplateDir, "*.txt"))
+	if err != nil {
+		return t, err
+	}
+	if len(partials) > 0 {
+		if t.text, err = t.text.ParseFiles(partials...); err != nil {
+			return t, fmt.Errorf("parsing text partials: %w", err)
+		}
+	}
+
+	return t, nil
+}
+
+// readTemplate returns the contents of the template file at path, or the built-in template if no path is set
+func readTemplate(path, builtin string) (string, error) {
+	if path == "" {
+		return builtin, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading template: %w", err)
+	}
+	return string(data), nil
+}
+
+func (a app) generateHTML(e emailBody) string {
+	t, err := a.Templates.html.Clone()
+	if err != nil {
+		log.Error().Err(err).Msg("error cloning template")
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err = t.Funcs(a.funcMap(e)).Execute(&buf, e); err != nil {
+		log.Error().Err(err).Msg("error executing template")
+	}
+
+	return buf.String()
+}
+
+// generateText renders the plain text version of the digest
+func (a app) generateText(e emailBody) string {
+	t, err := a.Templates.text.Clone()
+	if err != nil {
+		log.Error().Err(err).Msg("error cloning text template")
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err = t.Funcs(texttemplate.FuncMap(a.funcMap(e))).Execute(&buf, e); err != nil {
+		log.Error().Err(err).Msg("error executing text template")
+	}
+
+	return buf.String()
+}
+
+// runTemplatesCommand handles the "templates" sub-command
+func runTemplatesCommand(args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "export-default" {
+		log.Fatal().Msg("usage: templates export-default [directory]")
+	}
+
+	dir := "."
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal().Err(err).Str("path", dir).Msg("error creating template directory")
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"digest.html", emailTemplate},
+		{"digest.txt", textTemplate},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if _, err := os.Stat(path); err == nil {
+			log.Fatal().Str("path", path).Msg("template file already exists, refusing to overwrite it")
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("error writing template")
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+}
+
+const emailTemplate = `
+<html xmlns="http://www.w3.org/1999/xhtml"
+    style='box-sizing:border-box; font-family:"Helvetica Neue", Helvetica, Arial, sans-serif'>
+
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8=">
+    <meta name="viewport" content="width=device-width">
+    <title></title>
+
+
+</head>
+
+<body style="height:100%; margin:0; width:100%; background-color:#fff" height="100%" width="100%" bgcolor="#ffffff">
+
+    <style type="text/css">
+        @media only screen and (max-width: 640px) {
+            body {
+                padding: 0 !important
+            }
+
+            h1,
+            h2,
+            h3,
+            h4 {
+                font-weight: 800 !important;
+                margin: 20px 0 5px !important
+            }
+
+            h1 {
+                font-size: 22px !important
+            }
+
+            h2 {
+                font-size: 18px !important
+            }
+
+            h3 {
+                font-size: 16px !important
+            }
+
+            .container {
+                padding: 0 !important;
+                width: 100% !important
+            }
+
+            .content {
+                padding: 0 !important
+            }
+
+            .content-wrap {
+                padding: 10px !important
+            }
+
+            .invoice {
+                width: 100% !important
+            }
+        }
+    </style>
+    <base target="_target">
+    <table style="table-layout:fixed; width:100%; max-width:600px; clear:both !important; margin:0 auto !important"
+        width="100%">
+
+		{{range .Failed}}
+        <tr>
+            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none; color:#b00020" valign="top">
+                Unable to retrieve tweets from {{.Source}}: {{.Err}}
+            </td>
+        </tr>
+		{{end}}
+
+		{{range .Truncated}}
+        <tr>
+            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none; color:#4e555b" valign="top">
+                Tweets from {{.Source}} were truncated: the maximum number of tweets was reached before {{if .SinceLast}}the last delivered tweet, older tweets since the previous digest were skipped{{else}}the start of the digest window{{end}}.
+            </td>
+        </tr>
+		{{end}}
+
+		{{if .Highlights}}
+        <tr>
+            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none; background-color:#f5f8fa" valign="top" bgcolor="#f5f8fa">
+                <strong>Highlights</strong>
+                {{range .Highlights}}{{with or .RetweetedStatus .}}
+                <p style="margin:5px 0">
+                    <a href="{{permalink .}}" target="_blank" style="color:black; text-decoration:None">
+                        <strong>{{.User.Name}}</strong>
+                        <span>@{{.User.ScreenName}}</span>
+                    </a>
+                    <span style="color:#4e555b">{{.FavoriteCount}} likes, {{.RetweetCount}} retweets</span><br>
+                    {{excerpt .}}
+                </p>
+                {{end}}{{end}}
+            </td>
+        </tr>
+		{{end}}
+
+		{{range .Tweets}}
+        
+
+{{ if .RetweetedStatus }}
+
+<tr>
+            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none" valign="top">
+<img style="max-width:100%; display:inline; height:10px; padding-top:1px; vertical-align:baseline; width:auto" src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png" height="10" valign="baseline" width="auto"> {{.User.ScreenName}} Retweeted <br>
+                <table style="table-layout:fixed; width:100%" width="100%">
+                    <tr>
+						
+                        <td style="vertical-align:top; text-align:center; width:60px" valign="top" align="center"
+                            width="60">
+
+
+                            <img style="max-width:100%; border-radius:50%; height:48px; min-width:48px; width:48px"
+                                src="{{.RetweetedStatus.User.ProfileImageUrlHttps}}"
+                                height="48" width="48">
+                        </td>
+                        <td style="vertical-align:top" valign="top">
+                            <table cellpadding="0" cellspacing="0" border="0"
+                                style="table-layout:fixed; width:100%; padding-left:5px" width="100%">
+                                <tr>
+                                    <td style="vertical-align:top" valign="top">
+
+                                        <a href="{{permalink .RetweetedStatus}}"
+                                            style="color:black; text-decoration:None">
+                                            <strong>{{ .RetweetedStatus.User.Name }}</strong>
+                                            <span>@{{.RetweetedStatus.User.ScreenName}}</span>
+                                            <span style="float:right;">{{.RetweetedStatus | formatTime }}</span>
+                                        </a>
+                                    </td>
+                                </tr>
+                                <tr>
+                                    <td style="vertical-align:top" valign="top">
+
+                                        <p style="margin-bottom:10px; margin:0; padding-bottom:5px; white-space:pre-wrap">
+{{ renderText .RetweetedStatus }}    
+										</p>
+
+{{range .RetweetedStatus.ExtendedEntities.Media}}
+<img src="{{mediaSrc .}}"  style="max-width:100%; padding-bottom:5px">
+{{end}}
+
+{{range .RetweetedStatus.Entities.Urls}}
+
+<table style="table-layout:fixed; width:100%; border-radius:12px; border:1px solid #E2E6E6; padding:5px; margin:5px 0"   width="100%">
+    <tr>
+
+        <td style="vertical-align:top" valign="top">
+            <table cellpadding="0" cellspacing="0" border="0"
+                style="table-layout:fixed; width:100%; padding-left:5px"
+                width="100%">
+                <tr>
+                    <td style="vertical-align:top" valign="top">
+                        <p
+                            style="margin-bottom:10px; margin:0; overflow:hidden; text-overflow:inherit; white-space:normal">
+                            <a href="{{.Expanded_url | unshortenURL}}"
+                                target="_blank"
+                                style="color:#000; text-decoration:None">
+                                {{.Expanded_url | getTwitterImage}}
+
+                                <strong>{{.Expanded_url | unshortenURL}}</strong>
+                            </a>
+                        </p>
+                    </td>
+                </tr>
+
+                
+
+            </table>
+
+        </td>
+    </tr>
+</table>
+
+{{end}}
+
+                                    </td>
+                                </tr>
+
+
+                                <td style="vertical-align:top" valign="top">
+                                    <table style="table-layout:fixed; width:100%" width="100%">
+                                        <tr>
+                                            <a href="{{permalink .}}"
+                                                target="_blank" style="color:#348eda; text-decoration:None">
+                                                <p style="margin-bottom:10px; margin:0">
+
+                                                    <span style="color:#4e555b; margin-right:28px">
+                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png"
+                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
+                                                            height="16" valign="text-top" width="auto">
+                                                        <span>{{.RetweetedStatus.RetweetCount}}</span>
+                                                    </span>
+                                                    <span style="color:#4e555b; margin-right:28px">
+                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/c/c9/Twitter_favorite.png"
+                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
+                                                            height="16" valign="text-top" width="auto">
+                                                        <span>{{.RetweetedStatus.FavoriteCount}}</span>
+                                                    </span>
+                                                </p>
+                                            </a>
+                                        </tr>
+                                    </table>
+                                </td>
+                            </table>
+                            <a href="{{profileURL .RetweetedStatus.User}}"
+                                target="_blank" style="color:#348eda; text-decoration:None"></a>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+{{ else }}
+<tr>
+            <td style="vertical-align:top; border:1px solid #E2E6E6; padding:5px; border-bottom:none" valign="top">
+{{with thread .}}<span style="color:#4e555b">thread ({{len .Tweets}} tweets)</span> <br>{{end}}
+
+                <table style="table-layout:fixed; width:100%" width="100%">
+                    <tr>
+
+                        <td style="vertical-align:top; text-align:center; width:60px" valign="top" align="center"
+                            width="60">
+                            <img style="max-width:100%; border-radius:50%; height:48px; min-width:48px; width:48px"
+                                src="{{.User.ProfileImageUrlHttps}}"
+                                height="48" width="48">
+                        </td>
+                        <td style="vertical-align:top" valign="top">
+                            <table cellpadding="0" cellspacing="0" border="0"
+                                style="table-layout:fixed; width:100%; padding-left:5px" width="100%">
+                                <tr>
+                                    <td style="vertical-align:top" valign="top">
+
+                                        <a href="{{permalink .}}"
+                                            style="color:black; text-decoration:None">
+                                            <strong>{{ .User.Name }}</strong>
+                                            <span>@{{.User.ScreenName}}</span>
+                                            <span style="float:right;">{{. | formatTime }}</span>
+                                        </a>
+                                    </td>
+                                </tr>
+                                <tr>
+                                    <td style="vertical-align:top" valign="top">
+
+                                        <p style="margin-bottom:10px; margin:0; padding-bottom:5px; white-space:pre-wrap">
+{{ renderText . }}    
+										</p>
+
+{{range .ExtendedEntities.Media}}
+<img src="{{mediaSrc .}}"  style="max-width:100%; padding-bottom:5px">
+{{end}}
+
+{{range .Entities.Urls}}
+
+<table style="table-layout:fixed; width:100%; border-radius:12px; border:1px solid #E2E6E6; padding:5px; margin:5px 0"   width="100%">
+    <tr>
+
+        <td style="vertical-align:top" valign="top">
+            <table cellpadding="0" cellspacing="0" border="0"
+                style="table-layout:fixed; width:100%; padding-left:5px"
+                width="100%">
+                <tr>
+                    <td style="vertical-align:top" valign="top">
+                        <p
+                            style="margin-bottom:10px; margin:0; overflow:hidden; text-overflow:inherit; white-space:normal">
+                            <a href="{{.Expanded_url | unshortenURL}}"
+                                target="_blank"
+                                style="color:#000; text-decoration:None">
+                                {{.Expanded_url | getTwitterImage}}
+
+                                <strong>{{.Expanded_url | unshortenURL}}</strong>
+                            </a>
+                        </p>
+                    </td>
+                </tr>
+
+                
+
+            </table>
+        </td>
+    </tr>
+</table>
+{{end}}
+
+{{with thread .}}{{range .Replies}}
+<p style="margin-bottom:10px; margin:0; padding:5px 0; border-top:1px solid #E2E6E6; white-space:pre-wrap">
+{{ renderText . }}
+</p>
+
+{{range .ExtendedEntities.Media}}
+<img src="{{mediaSrc .}}"  style="max-width:100%; padding-bottom:5px">
+{{end}}
+
+{{range .Entities.Urls}}
+<p style="margin-bottom:10px; margin:0; padding-bottom:5px; overflow:hidden; text-overflow:inherit; white-space:normal">
+    <a href="{{.Expanded_url | unshortenURL}}" target="_blank" style="color:#000; text-decoration:None">
+        {{.Expanded_url | getTwitterImage}}
+
+        <strong>{{.Expanded_url | unshortenURL}}</strong>
+    </a>
+</p>
+{{end}}
+{{end}}{{end}}
+
+                                    </td>
+                                </tr>
+
+
+                                <td style="vertical-align:top" valign="top">
+                                    <table style="table-layout:fixed; width:100%" width="100%">
+                                        <tr>
+                                            <a href="{{permalink .}}"
+                                                target="_blank" style="color:#348eda; text-decoration:None">
+                                                <p style="margin-bottom:10px; margin:0">
+
+                                                    <span style="color:#4e555b; margin-right:28px">
+                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/7/70/Retweet.png"
+                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
+                                                            height="16" valign="text-top" width="auto">
+                                                        <span>{{.RetweetCount}}</span>
+                                                    </span>
+                                                    <span style="color:#4e555b; margin-right:28px">
+                                                        <img src="https://upload.wikimedia.org/wikipedia/commons/c/c9/Twitter_favorite.png"
+                                                            style="max-width:100%; display:inline; height:16px; padding-top:1px; vertical-align:text-top; width:auto"
+                                                            height="16" valign="text-top" width="auto">
+                                                        <span>{{.FavoriteCount}}</span>
+                                                    </span>
+                                                </p>
+                                            </a>
+                                        </tr>
+                                    </table>
+                                </td>
+                            </table>
+                            <a href="{{profileURL .User}}"
+                                target="_blank" style="color:#348eda; text-decoration:None"></a>
+                        </td>
+                    </tr>
+                </table>
+            </td>
+        </tr>
+
+{{ end }}
+		{{end}}
+
+        
+    </table>
+
+
+
+
+
+
+</body>
+
+</html>
+`
+
+const textTemplate = `{{range .Failed}}Unable to retrieve tweets from {{.Source}}: {{.Err}}
+{{end}}{{range .Truncated}}Tweets from {{.Source}} were truncated: the maximum number of tweets was reached before {{if .SinceLast}}the last delivered tweet, older tweets since the previous digest were skipped{{else}}the start of the digest window{{end}}.
+{{end}}{{if or .Failed .Truncated}}
+{{end}}{{if .Highlights}}Highlights
+{{range .Highlights}}{{with or .RetweetedStatus .}}- {{.User.Name}} (@{{.User.ScreenName}}): {{excerpt .}}
+  {{.FavoriteCount}} likes, {{.RetweetCount}} retweets - {{permalink .}}
+{{end}}{{end}}
+------------------------------------------------------------
+
+{{end}}{{range .Tweets}}{{if .RetweetedStatus}}@{{.User.ScreenName}} Retweeted
+{{template "tweet" .RetweetedStatus}}{{else}}{{template "tweet" .}}{{end}}
+------------------------------------------------------------
+
+{{end}}
+
+{{- define "tweet"}}{{.User.Name}} (@{{.User.ScreenName}}) - {{formatTime .}}{{with thread .}} - thread ({{len .Tweets}} tweets){{end}}
+
+{{plainText .}}
+{{range .ExtendedEntities.Media}}{{mediaLink .}}
+{{end}}{{with thread .}}{{range .Replies}}
+{{plainText .}}
+{{range .ExtendedEntities.Media}}{{mediaLink .}}
+{{end}}{{end}}{{end}}
+Retweets: {{.RetweetCount}}  Likes: {{.FavoriteCount}}
+{{permalink .}}
+{{end}}`
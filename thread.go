@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// maxThreadAncestors limits the number of tweets requested to complete the start of a single thread
+const maxThreadAncestors = 10
+
+// tweetLookup is implemented by the sources that can retrieve single tweets. It is used to fetch the start of a
+// thread that is older than the digest window.
+type tweetLookup interface {
+	// Parent returns the tweet a reply responds to
+	Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error)
+}
+
+// digestThread is a chain of replies of an author to their own tweets, rendered as a single card
+type digestThread struct {
+	// Tweets are the tweets of the thread, oldest first. The first tweet is the one shown in the timeline.
+	Tweets []anaconda.Tweet
+}
+
+// Replies returns the tweets that follow the first tweet of the thread
+func (t digestThread) Replies() []anaconda.Tweet {
+	return t.Tweets[1:]
+}
+
+// isSelfReply reports whether a tweet replies to a tweet of the same author
+func isSelfReply(t anaconda.Tweet) bool {
+	return t.RetweetedStatus == nil && t.InReplyToStatusIdStr != "" && t.InReplyToUserID == t.User.Id
+}
+
+// tweetKeys returns the IDs a reply can refer to a tweet by. Posts from other networks are referred to by their URL
+// (Bluesky) or their numeric ID (Mastodon).
+func tweetKeys(t anaconda.Tweet) []string {
+	keys := []string{t.IdStr}
+	if id := strconv.FormatInt(t.Id, 10); t.Id != 0 && id != t.IdStr {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// parentKeys returns the IDs of the tweet a reply responds to, see tweetKeys
+func parentKeys(t anaconda.Tweet) []string {
+	keys := []string{t.InReplyToStatusIdStr}
+	if id := strconv.FormatInt(t.InReplyToStatusID, 10); t.InReplyToStatusID != 0 && id != t.InReplyToStatusIdStr {
+		keys = append(keys, id)
+	}
+	return keys
+}
+
+// groupThreads merges the chains of self-replies of a timeline (oldest first) into threads. Each thread takes the
+// place of its first tweet in the timeline and is returned keyed by the ID of that tweet. Retrieved are the tweets
+// of the digest window before the filters were applied: self-replies that were filtered out are skipped when a
+// thread is put together. When the start of a thread is missing from the timeline it is requested from the source,
+// if the source supports it.
+func (a app) groupThreads(ctx context.Context, src tweetSource, label string, tweets, retrieved []anaconda.Tweet) ([]anaconda.Tweet, map[string]digestThread) {
+	index := make(map[string]int, len(tweets))
+	for i, t := range tweets {
+		for _, key := range tweetKeys(t) {
+			index[key] = i
+		}
+	}
+	dropped := make(map[string]anaconda.Tweet)
+	for _, t := range retrieved {
+		if _, ok := index[t.IdStr]; !ok {
+			for _, key := range tweetKeys(t) {
+				dropped[key] = t
+			}
+		}
+	}
+
+	// link every self-reply to its parent, a tweet with several self-replies continues with the first one.
+	// Self-replies whose parent isn't part of the timeline are orphans.
+	children := make(map[int][]int)
+	hasParent, orphan := make(map[int]bool), make(map[int]bool)
+	for i, t := range tweets {
+		if !isSelfReply(t) {
+			continue
+		}
+		orphan[i] = true
+		if p, ok := lookupKeys(index, parentKeys(t)); ok && p < i {
+			if len(children[p]) == 0 {
+				children[p], hasParent[i] = []int{i}, true
+			}
+			orphan[i] = false
+		}
+	}
+
+	// an orphan continues a thread of the timeline if the tweets between them were filtered out or can be
+	// requested, otherwise the requested tweets start its thread. The requested tweets are indexed as part of the
+	// thread of the orphan, so they are only included once.
+	lookup, _ := src.(tweetLookup)
+	ancestors := make(map[int][]anaconda.Tweet)
+	for i, t := range tweets {
+		if !orphan[i] {
+			continue
+		}
+		var p int
+		ancestors[i], p = a.threadAncestors(ctx, lookup, label, t, index, dropped)
+		if p >= 0 && p < i {
+			children[p], hasParent[i] = append(children[p], i), true
+		}
+		for _, ancestor := range ancestors[i] {
+			for _, key := range tweetKeys(ancestor) {
+				index[key] = i
+			}
+		}
+	}
+
+	var timeline []anaconda.Tweet
+	var threads map[string]digestThread
+	for i := range tweets {
+		if hasParent[i] {
+			continue
+		}
+
+		var chain []anaconda.Tweet
+		var walk func(j int)
+		walk = func(j int) {
+			chain = append(chain, ancestors[j]...)
+			chain = append(chain, tweets[j])
+			for _, c := range children[j] {
+				walk(c)
+			}
+		}
+		walk(i)
+
+		timeline = append(timeline, chain[0])
+		if len(chain) > 1 {
+			if threads == nil {
+				threads = make(map[string]digestThread)
+			}
+			threads[chain[0].IdStr] = digestThread{Tweets: chain}
+		}
+	}
+
+	return timeline, threads
+}
+
+// threadAncestors returns the tweets a self-reply continues, oldest first, up to a tweet in the index. Self-replies
+// that were filtered out (dropped) are skipped, the others are requested if the source supports it (lookup isn't
+// nil). The index of the tweet the reply continues is returned, or -1 if the returned tweets start the thread.
+// Failed requests are logged and end the search, so the thread starts with the tweets that could be retrieved.
+func (a app) threadAncestors(ctx context.Context, lookup tweetLookup, label string, reply anaconda.Tweet, index map[string]int, dropped map[string]anaconda.Tweet) ([]anaconda.Tweet, int) {
+	var ancestors []anaconda.Tweet
+	skipped := make(map[string]bool)
+	for len(ancestors) < maxThreadAncestors && isSelfReply(reply) {
+		keys := parentKeys(reply)
+		if p, ok := lookupKeys(index, keys); ok {
+			return ancestors, p
+		}
+		if parent, ok := lookupTweet(dropped, keys); ok && !skipped[parent.IdStr] {
+			skipped[parent.IdStr] = true
+			reply = parent
+			continue
+		}
+		if lookup == nil {
+			break
+		}
+
+		parent, err := lookup.Parent(ctx, reply)
+		if err != nil {
+			log.Warn().Err(err).Str("source", label).Str("tweet", reply.InReplyToStatusIdStr).Msg("unable to retrieve the start of a thread")
+			break
+		}
+		ancestors = append([]anaconda.Tweet{parent}, ancestors...)
+		reply = parent
+	}
+	return ancestors, -1
+}
+
+// lookupKeys returns the index of the first of the keys that is in the index
+func lookupKeys(index map[string]int, keys []string) (int, bool) {
+	for _, key := range keys {
+		if i, ok := index[key]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// lookupTweet returns the tweet of the first of the keys that is in tweets
+func lookupTweet(tweets map[string]anaconda.Tweet, keys []string) (anaconda.Tweet, bool) {
+	for _, key := range keys {
+		if t, ok := tweets[key]; ok {
+			return t, true
+		}
+	}
+	return anaconda.Tweet{}, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ChimeraCoder/anaconda"
+)
+
+// lookupSource serves the parents of replies from a fixed set of tweets
+type lookupSource struct {
+	tweets   map[string]anaconda.Tweet
+	requests int
+}
+
+func (s *lookupSource) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	return nil, "", nil
+}
+
+func (s *lookupSource) Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error) {
+	s.requests++
+	t, ok := s.tweets[reply.InReplyToStatusIdStr]
+	if !ok {
+		return t, errors.New("not found")
+	}
+	return t, nil
+}
+
+func TestGroupThreads(t *testing.T) {
+	// tweets of the same account, each one but the first replies to the one before
+	var chain []anaconda.Tweet
+	for i, id := range []string{"1", "2", "3", "4"} {
+		tweet := anaconda.Tweet{Id: int64(i + 1), IdStr: id, User: anaconda.User{Id: 7, ScreenName: "golang"}}
+		if i > 0 {
+			tweet.InReplyToStatusID, tweet.InReplyToStatusIdStr, tweet.InReplyToUserID = int64(i), chain[i-1].IdStr, 7
+		}
+		chain = append(chain, tweet)
+	}
+	other := anaconda.Tweet{Id: 5, IdStr: "5", User: anaconda.User{Id: 8}, InReplyToStatusIdStr: "1", InReplyToUserID: 7}
+	ids := func(tweets []anaconda.Tweet) string {
+		var s []string
+		for _, t := range tweets {
+			s = append(s, t.IdStr)
+		}
+		return strings.Join(s, " ")
+	}
+
+	t.Run("timeline", func(t *testing.T) {
+		// the self-replies are moved into the thread of the first tweet, the reply of another account stays
+		timeline, threads := app{}.groupThreads(context.Background(), &lookupSource{}, "test", append(chain, other), append(chain, other))
+		if got := ids(timeline); got != "1 5" {
+			t.Errorf("timeline = %s, want 1 5", got)
+		}
+		if got := ids(threads["1"].Tweets); len(threads) != 1 || got != "1 2 3 4" {
+			t.Errorf("threads = %+v, want 1 2 3 4", threads)
+		}
+	})
+
+	t.Run("filtered tweets", func(t *testing.T) {
+		// tweets 2 and 3 were retrieved but filtered out, they are neither requested nor shown
+		src := &lookupSource{}
+		timeline, threads := app{}.groupThreads(context.Background(), src, "test", []anaconda.Tweet{chain[0], chain[3]}, chain)
+		if got := ids(timeline); got != "1" || src.requests != 0 {
+			t.Errorf("timeline = %s after %d requests, want 1 without requests", got, src.requests)
+		}
+		if got := ids(threads["1"].Tweets); got != "1 4" {
+			t.Errorf("thread = %s, want 1 4", got)
+		}
+	})
+
+	t.Run("missing start", func(t *testing.T) {
+		// the start of the thread is requested, the lookup of its parent fails after tweet 2
+		src := &lookupSource{tweets: map[string]anaconda.Tweet{"2": chain[1]}}
+		timeline, threads := app{}.groupThreads(context.Background(), src, "test", chain[2:], chain[2:])
+		if got := ids(timeline); got != "2" || src.requests != 2 {
+			t.Errorf("timeline = %s after %d requests, want 2 after 2", got, src.requests)
+		}
+		if got := ids(threads["2"].Tweets); got != "2 3 4" {
+			t.Errorf("thread = %s, want 2 3 4", got)
+		}
+	})
+}
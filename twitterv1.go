@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// maximum number of tweets returned by a single search request
+const maxSearchCount = 100
+
+// twitterV1Source retrieves a timeline from the Twitter API v1.1 using anaconda
+type twitterV1Source struct {
+	app    app
+	source timelineSource
+}
+
+// params returns the request parameters for the first page of a timeline
+func (s timelineSource) params(count int) url.Values {
+	v := url.Values{}
+	switch s.Kind {
+	case sourceUser, sourceLikes:
+		v.Set("screen_name", s.Name)
+	case sourceSearch:
+		v.Set("result_type", "recent")
+		if count > maxSearchCount {
+			count = maxSearchCount
+		}
+	}
+	v.Set("count", strconv.Itoa(count))
+
+	return v
+}
+
+// Page requests a single page of the timeline using max_id, retrying according to the retry policy
+func (t twitterV1Source) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	a, s := t.app, t.source
+	v := s.params(a.Config.TweetCount)
+	if sinceID > 0 {
+		v.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if cursor != "" {
+		v.Set("max_id", cursor)
+	}
+
+	var timeline []anaconda.Tweet
+
+	var endpoint string
+	switch s.Kind {
+	case sourceList:
+		endpoint = "lists/statuses"
+	case sourceSearch:
+		endpoint = "search/tweets"
+	case sourceHome:
+		endpoint = "statuses/home_timeline"
+	case sourceLikes:
+		endpoint = "favorites/list"
+	default:
+		endpoint = "statuses/user_timeline"
+	}
+
+	err := a.Config.Retry.do(ctx, strings.TrimSpace(endpoint+" "+s.Name), func() error {
+		var err error
+		switch s.Kind {
+		case sourceList:
+			if s.ListID != 0 {
+				timeline, err = a.Client.GetListTweets(s.ListID, a.Config.IncludeRetweets, v)
+			} else {
+				timeline, err = a.Client.GetListTweetsBySlug(s.Slug, s.Owner, a.Config.IncludeRetweets, v)
+			}
+		case sourceSearch:
+			var sr anaconda.SearchResponse
+			sr, err = a.Client.GetSearch(s.Name, v)
+			timeline = sr.Statuses
+		case sourceHome:
+			timeline, err = a.Client.GetHomeTimeline(v)
+		case sourceLikes:
+			timeline, err = a.Client.GetFavorites(v)
+		default:
+			timeline, err = a.Client.GetUserTimeline(v)
+		}
+		return err
+	})
+	log.Debug().Int("tweet-count", len(timeline)).Str("source", s.String()).Str("max_id", v.Get("max_id")).Msg("pulled down tweets")
+	if err != nil || len(timeline) == 0 {
+		return timeline, "", err
+	}
+
+	return timeline, strconv.FormatInt(timeline[len(timeline)-1].Id-1, 10), nil
+}
+
+// Parent requests the tweet a reply responds to, retrying according to the retry policy
+func (t twitterV1Source) Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error) {
+	var tweet anaconda.Tweet
+	err := t.app.Config.Retry.do(ctx, "statuses/show "+reply.InReplyToStatusIdStr, func() error {
+		var err error
+		tweet, err = t.app.Client.GetTweet(reply.InReplyToStatusID, nil)
+		return err
+	})
+	return tweet, err
+}
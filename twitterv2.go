@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/rs/zerolog/log"
+)
+
+// Twitter APIs supported by --twitter-api
+const (
+	twitterAPIv1 = "v1.1"
+	twitterAPIv2 = "v2"
+)
+
+const twitterV2BaseURL = "https://api.twitter.com/2"
+
+// twitterV2Fields are requested with every timeline so the tweets can be mapped into the same model as the v1.1 API
+var twitterV2Fields = url.Values{
+	"tweet.fields": {"created_at,author_id,entities,public_metrics,referenced_tweets,in_reply_to_user_id,attachments,lang,source"},
+	"expansions":   {"author_id,referenced_tweets.id,referenced_tweets.id.author_id,attachments.media_keys"},
+	"user.fields":  {"name,username,profile_image_url,public_metrics,verified"},
+	"media.fields": {"url,preview_image_url,type"},
+}
+
+// twitterV2Client requests timelines from the Twitter API v2 using an app-only bearer token
+type twitterV2Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+
+	// userIDs caches the IDs of the usernames that have been looked up
+	mu      sync.Mutex
+	userIDs map[string]string
+}
+
+func newTwitterV2Client(token string) *twitterV2Client {
+	return &twitterV2Client{
+		baseURL: twitterV2BaseURL,
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+		userIDs: make(map[string]string),
+	}
+}
+
+// twitterV2Response is the response of the v2 timeline endpoints
+type twitterV2Response struct {
+	Data     []twitterV2Tweet `json:"data"`
+	Includes struct {
+		Users  []twitterV2User  `json:"users"`
+		Tweets []twitterV2Tweet `json:"tweets"`
+		Media  []twitterV2Media `json:"media"`
+	} `json:"includes"`
+	Meta struct {
+		NextToken string `json:"next_token"`
+	} `json:"meta"`
+	Errors []twitterV2Error `json:"errors"`
+}
+
+type twitterV2Tweet struct {
+	ID               string    `json:"id"`
+	Text             string    `json:"text"`
+	AuthorID         string    `json:"author_id"`
+	CreatedAt        time.Time `json:"created_at"`
+	InReplyToUserID  string    `json:"in_reply_to_user_id"`
+	Lang             string    `json:"lang"`
+	Source           string    `json:"source"`
+	ReferencedTweets []struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"referenced_tweets"`
+	Attachments struct {
+		MediaKeys []string `json:"media_keys"`
+	} `json:"attachments"`
+	Entities struct {
+		URLs []struct {
+			Start       int    `json:"start"`
+			End         int    `json:"end"`
+			URL         string `json:"url"`
+			ExpandedURL string `json:"expanded_url"`
+			DisplayURL  string `json:"display_url"`
+			MediaKey    string `json:"media_key"`
+		} `json:"urls"`
+		Mentions []struct {
+			Start    int    `json:"start"`
+			End      int    `json:"end"`
+			Username string `json:"username"`
+			ID       string `json:"id"`
+		} `json:"mentions"`
+		Hashtags []struct {
+			Start int    `json:"start"`
+			End   int    `json:"end"`
+			Tag   string `json:"tag"`
+		} `json:"hashtags"`
+	} `json:"entities"`
+	PublicMetrics struct {
+		RetweetCount int `json:"retweet_count"`
+		LikeCount    int `json:"like_count"`
+	} `json:"public_metrics"`
+}
+
+type twitterV2User struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Username        string `json:"username"`
+	ProfileImageURL string `json:"profile_image_url"`
+	Verified        bool   `json:"verified"`
+	PublicMetrics   struct {
+		FollowersCount int `json:"followers_count"`
+	} `json:"public_metrics"`
+}
+
+type twitterV2Media struct {
+	MediaKey        string `json:"media_key"`
+	Type            string `json:"type"`
+	URL             string `json:"url"`
+	PreviewImageURL string `json:"preview_image_url"`
+}
+
+// twitterV2Error is an error returned in the body of a successful response, e.g. for a missing account
+type twitterV2Error struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	Type   string `json:"type"`
+}
+
+// err converts the error into an *httpError with a matching status code so it is classified like other API errors
+func (e twitterV2Error) err(endpoint string) error {
+	status := http.StatusBadRequest
+	switch {
+	case strings.HasSuffix(e.Type, "/resource-not-found"):
+		status = http.StatusNotFound
+	case strings.HasSuffix(e.Type, "/not-authorized-for-resource"):
+		status = http.StatusForbidden
+	}
+
+	msg := e.Detail
+	if msg == "" {
+		msg = e.Title
+	}
+	return &httpError{StatusCode: status, Message: msg, URL: endpoint}
+}
+
+// get sends an authenticated request to the v2 API
+func (c *twitterV2Client) get(ctx context.Context, path string, v url.Values, out interface{}) error {
+	u := c.baseURL + path
+	if len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer "+c.token)
+	return getJSON(ctx, c.http, u, h, out)
+}
+
+// userID returns the ID of a username, which the v2 endpoints take instead of the username
+func (c *twitterV2Client) userID(ctx context.Context, username string) (string, error) {
+	key := strings.ToLower(username)
+
+	c.mu.Lock()
+	id, ok := c.userIDs[key]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var resp struct {
+		Data *struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		Errors []twitterV2Error `json:"errors"`
+	}
+	path := "/users/by/username/" + url.PathEscape(username)
+	if err := c.get(ctx, path, nil, &resp); err != nil {
+		return "", err
+	}
+	if resp.Data == nil {
+		if len(resp.Errors) > 0 {
+			return "", resp.Errors[0].err(c.baseURL + path)
+		}
+		return "", &httpError{StatusCode: http.StatusNotFound, URL: c.baseURL + path}
+	}
+
+	c.mu.Lock()
+	c.userIDs[key] = resp.Data.ID
+	c.mu.Unlock()
+
+	return resp.Data.ID, nil
+}
+
+// twitterV2Source retrieves a timeline from the Twitter API v2
+type twitterV2Source struct {
+	app    app
+	client *twitterV2Client
+	source timelineSource
+}
+
+// source returns the v2 implementation of a timeline. The home timeline requires user authentication
+// and isn't available with a bearer token.
+func (c *twitterV2Client) source(a app, s timelineSource) (tweetSource, error) {
+	switch s.Kind {
+	case sourceUser, sourceSearch, sourceLikes:
+	case sourceList:
+		if s.ListID == 0 {
+			return nil, fmt.Errorf("%s: lists have to be given by ID with the Twitter API v2", s)
+		}
+	default:
+		return nil, fmt.Errorf("the %s is not available with the Twitter API v2", s)
+	}
+
+	return twitterV2Source{app: a, client: c, source: s}, nil
+}
+
+// Page requests a single page of the timeline, retrying according to the retry policy.
+// Endpoints that don't support since_id are paginated until the last delivered tweet is reached.
+func (t twitterV2Source) Page(ctx context.Context, sinceID int64, cursor string) ([]anaconda.Tweet, string, error) {
+	a, s := t.app, t.source
+
+	v := url.Values{}
+	for k, f := range twitterV2Fields {
+		v[k] = f
+	}
+	count := a.Config.TweetCount
+	if count < 10 {
+		count = 10
+	} else if count > 100 {
+		count = 100
+	}
+	v.Set("max_results", strconv.Itoa(count))
+
+	var path string
+	supportsSinceID, tokenParam := false, "pagination_token"
+	switch s.Kind {
+	case sourceUser, sourceLikes:
+		var id string
+		err := a.Config.Retry.do(ctx, "users/by/username "+s.Name, func() error {
+			var err error
+			id, err = t.client.userID(ctx, s.Name)
+			return err
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if s.Kind == sourceUser {
+			path, supportsSinceID = "/users/"+id+"/tweets", true
+		} else {
+			path = "/users/" + id + "/liked_tweets"
+		}
+	case sourceList:
+		path = "/lists/" + strconv.FormatInt(s.ListID, 10) + "/tweets"
+	case sourceSearch:
+		path, supportsSinceID, tokenParam = "/tweets/search/recent", true, "next_token"
+		v.Set("query", s.Name)
+	}
+	if sinceID > 0 && supportsSinceID {
+		v.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if cursor != "" {
+		v.Set(tokenParam, cursor)
+	}
+
+	var resp twitterV2Response
+	err := a.Config.Retry.do(ctx, strings.TrimPrefix(path, "/")+" "+s.Name, func() error {
+		resp = twitterV2Response{}
+		return t.client.get(ctx, path, v, &resp)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(resp.Data) == 0 && len(resp.Errors) > 0 {
+		return nil, "", resp.Errors[0].err(t.client.baseURL + path)
+	}
+
+	idx := newTwitterV2Index(resp)
+	next := resp.Meta.NextToken
+	tweets := make([]anaconda.Tweet, 0, len(resp.Data))
+	for _, d := range resp.Data {
+		tweet := idx.convert(d, true)
+		if sinceID > 0 && tweet.Id <= sinceID {
+			next = ""
+			continue
+		}
+		tweets = append(tweets, tweet)
+	}
+	log.Debug().Int("tweet-count", len(tweets)).Str("source", s.String()).Str("cursor", cursor).Msg("pulled down tweets")
+
+	return tweets, next, nil
+}
+
+// Parent requests the tweet a reply responds to, retrying according to the retry policy
+func (t twitterV2Source) Parent(ctx context.Context, reply anaconda.Tweet) (anaconda.Tweet, error) {
+	v := url.Values{}
+	for k, f := range twitterV2Fields {
+		v[k] = f
+	}
+	v.Set("ids", reply.InReplyToStatusIdStr)
+
+	var resp twitterV2Response
+	err := t.app.Config.Retry.do(ctx, "tweets "+reply.InReplyToStatusIdStr, func() error {
+		resp = twitterV2Response{}
+		return t.client.get(ctx, "/tweets", v, &resp)
+	})
+	if err != nil {
+		return anaconda.Tweet{}, err
+	}
+	if len(resp.Data) == 0 {
+		if len(resp.Errors) > 0 {
+			return anaconda.Tweet{}, resp.Errors[0].err(t.client.baseURL + "/tweets")
+		}
+		return anaconda.Tweet{}, fmt.Errorf("tweet %s was not found", reply.InReplyToStatusIdStr)
+	}
+
+	return newTwitterV2Index(resp).convert(resp.Data[0], true), nil
+}
+
+// twitterV2Index holds the expanded objects of a response by ID
+type twitterV2Index struct {
+	users  map[string]twitterV2User
+	tweets map[string]twitterV2Tweet
+	media  map[string]twitterV2Media
+}
+
+func newTwitterV2Index(resp twitterV2Response) twitterV2Index {
+	idx := twitterV2Index{
+		users:  make(map[string]twitterV2User),
+		tweets: make(map[string]twitterV2Tweet),
+		media:  make(map[string]twitterV2Media),
+	}
+	for _, u := range resp.Includes.Users {
+		idx.users[u.ID] = u
+	}
+	for _, t := range resp.Includes.Tweets {
+		idx.tweets[t.ID] = t
+	}
+	for _, m := range resp.Includes.Media {
+		idx.media[m.MediaKey] = m
+	}
+	return idx
+}
+
+// convert maps a v2 tweet into the v1.1 model consumed by the templates. Retweeted and quoted tweets are
+// expanded one level deep.
+func (idx twitterV2Index) convert(t twitterV2Tweet, expand bool) anaconda.Tweet {
+	tweet := anaconda.Tweet{
+		IdStr:              t.ID,
+		FullText:           t.Text,
+		Text:               t.Text,
+		CreatedAt:          createdAt(t.CreatedAt),
+		Lang:               t.Lang,
+		Source:             twitterEscaper.Replace(t.Source),
+		RetweetCount:       t.PublicMetrics.RetweetCount,
+		FavoriteCount:      t.PublicMetrics.LikeCount,
+		InReplyToUserIdStr: t.InReplyToUserID,
+		User:               idx.user(t.AuthorID),
+	}
+	tweet.Id, _ = strconv.ParseInt(t.ID, 10, 64)
+	tweet.InReplyToUserID, _ = strconv.ParseInt(t.InReplyToUserID, 10, 64)
+	if u, ok := idx.users[t.InReplyToUserID]; ok {
+		tweet.InReplyToScreenName = u.Username
+	}
+
+	for _, ref := range t.ReferencedTweets {
+		id, _ := strconv.ParseInt(ref.ID, 10, 64)
+		included, ok := idx.tweets[ref.ID]
+
+		switch ref.Type {
+		case "replied_to":
+			tweet.InReplyToStatusID, tweet.InReplyToStatusIdStr = id, ref.ID
+		case "quoted":
+			tweet.QuotedStatusID, tweet.QuotedStatusIdStr = id, ref.ID
+			if ok && expand {
+				quoted := idx.convert(included, false)
+				tweet.QuotedStatus = &quoted
+			}
+		case "retweeted":
+			if ok && expand {
+				retweeted := idx.convert(included, false)
+				tweet.RetweetedStatus = &retweeted
+			}
+		}
+	}
+
+	for _, u := range t.Entities.URLs {
+		indices := []int{u.Start, u.End}
+		if m, ok := idx.media[u.MediaKey]; ok {
+			media := mediaEntity(m.imageURL(), m.Type)
+			media.Indices, media.Url, media.Display_url, media.Expanded_url = indices, u.URL, u.DisplayURL, u.ExpandedURL
+			tweet.Entities.Media = append(tweet.Entities.Media, media)
+			continue
+		}
+		tweet.Entities.Urls = append(tweet.Entities.Urls, urlEntity{Indices: indices, Url: u.URL, Display_url: u.DisplayURL, Expanded_url: u.ExpandedURL})
+	}
+	for _, m := range t.Entities.Mentions {
+		tweet.Entities.User_mentions = append(tweet.Entities.User_mentions, mentionEntity{Indices: []int{m.Start, m.End}, Screen_name: m.Username, Id_str: m.ID})
+	}
+	for _, h := range t.Entities.Hashtags {
+		tweet.Entities.Hashtags = append(tweet.Entities.Hashtags, hashtagEntity{Indices: []int{h.Start, h.End}, Text: h.Tag})
+	}
+	for _, key := range t.Attachments.MediaKeys {
+		if m, ok := idx.media[key]; ok && m.imageURL() != "" {
+			tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, mediaEntity(m.imageURL(), m.Type))
+		}
+	}
+
+	return tweet
+}
+
+// user returns the v1.1 representation of an included user
+func (idx twitterV2Index) user(id string) anaconda.User {
+	u := idx.users[id]
+	user := anaconda.User{
+		IdStr:                u.ID,
+		Name:                 u.Name,
+		ScreenName:           u.Username,
+		ProfileImageURL:      u.ProfileImageURL,
+		ProfileImageUrlHttps: u.ProfileImageURL,
+		FollowersCount:       u.PublicMetrics.FollowersCount,
+		Verified:             u.Verified,
+	}
+	user.Id, _ = strconv.ParseInt(u.ID, 10, 64)
+	return user
+}
+
+// imageURL returns the URL of the image, or the preview image for videos and GIFs
+func (m twitterV2Media) imageURL() string {
+	if m.URL != "" {
+		return m.URL
+	}
+	return m.PreviewImageURL
+}
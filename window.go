@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// digestWindow is the range of creation times of the tweets included in a digest
+type digestWindow struct {
+	// tweets created after Start and, if End is set, before End are included
+	Start, End time.Time
+	// OnThisDay selects the tweets created on the date of Today in previous years instead
+	OnThisDay bool
+	Today     time.Time
+}
+
+// window returns the digest window, which is relative to now (--duration) unless --from, --to or --on-this-day
+// were given. With only --to the window covers the --duration before it.
+func (a app) window() digestWindow {
+	now := time.Now().Local()
+	if a.Config.OnThisDay {
+		return digestWindow{OnThisDay: true, Today: now}
+	}
+
+	w := digestWindow{Start: now.Add(a.Config.Threshold), End: a.Config.To}
+	switch {
+	case !a.Config.From.IsZero():
+		w.Start = a.Config.From
+	case !a.Config.To.IsZero():
+		w.Start = a.Config.To.Add(a.Config.Threshold)
+	}
+	return w
+}
+
+// historical reports whether the digest window was set explicitly, in which case the state of previous digests
+// is ignored
+func (a app) historical() bool {
+	return a.Config.OnThisDay || !a.Config.From.IsZero() || !a.Config.To.IsZero()
+}
+
+// contains reports whether a tweet created at t belongs in the digest
+func (w digestWindow) contains(t time.Time) bool {
+	t = t.Local()
+	if w.OnThisDay {
+		return t.Month() == w.Today.Month() && t.Day() == w.Today.Day() && t.Year() < w.Today.Year()
+	}
+	return t.After(w.Start) && (w.End.IsZero() || t.Before(w.End))
+}
+
+// passed reports whether a tweet created at t is older than the window, so older tweets don't need to be retrieved
+func (w digestWindow) passed(t time.Time) bool {
+	return !w.OnThisDay && !t.After(w.Start)
+}
+
+// parseDate parses the value of --from or --to, either a date in the local timezone or an RFC 3339 time.
+// With end set a date refers to the end of that day.
+func parseDate(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or an RFC 3339 time", s)
+	}
+	return t, nil
+}